@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// ChangedFiles is the document written to PLUGIN_CHANGED_FILES_FILE
+type ChangedFiles struct {
+	Event string        `json:"event"`
+	Base  string        `json:"base"`
+	Head  string        `json:"head"`
+	Files []ChangedFile `json:"files"`
+}
+
+// changedFilesEnabled reports whether the changed files should be exported
+func changedFilesEnabled() bool {
+	return os.Getenv("PLUGIN_CHANGED_FILES") == "true" || os.Getenv("PLUGIN_CHANGED_FILES_FILE") != ""
+}
+
+// exportChangedFiles writes the files changed by the build to
+// PLUGIN_CHANGED_FILES_FILE as JSON and to DRONE_OUTPUT as JSON arrays, one
+// per status, so that any file name can be represented. Events without
+// changes to compare, such as tags, export an empty list. So do builds whose
+// changes cannot be determined, for example after a force push when the
+// previous commit is gone; the clone does not fail for it.
+func (p *postClone) exportChangedFiles() error {
+	changeRange, files, err := p.changes()
+	if err != nil {
+		slog.Warn("Cannot determine changed files, exporting an empty list", "error", err)
+		changeRange, files = nil, nil
+	}
+
+	doc := ChangedFiles{Event: cloneType(), Files: files}
+	if changeRange != nil {
+		doc.Base = changeRange.Base
+		doc.Head = changeRange.Head
+	} else if err == nil {
+		slog.Info("No changed files, the build event has no changes to compare", "event", doc.Event)
+	}
+	if doc.Files == nil {
+		doc.Files = []ChangedFile{}
+	}
+
+	byStatus := make(map[string][]string)
+	paths := []string{}
+	for _, file := range files {
+		paths = append(paths, file.Path)
+		byStatus[file.Status] = append(byStatus[file.Status], file.Path)
+	}
+
+	p.outputs["CHANGED_FILES"] = jsonList(paths)
+	p.outputs["CHANGED_FILES_COUNT"] = strconv.Itoa(len(files))
+	p.outputs["CHANGED_FILES_BASE"] = doc.Base
+	p.outputs["CHANGED_FILES_HEAD"] = doc.Head
+	for _, status := range []string{"added", "modified", "deleted", "renamed"} {
+		p.outputs[strings.ToUpper(status)+"_FILES"] = jsonList(byStatus[status])
+	}
+
+	fmt.Printf("[INFO] %d changed files\n", len(files))
+
+	file := os.Getenv("PLUGIN_CHANGED_FILES_FILE")
+	if file == "" {
+		return nil
+	}
+	p.outputs["CHANGED_FILES_FILE"] = file
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal changed files: %v", err)
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		return fmt.Errorf("failed to write changed files %s: %v", file, err)
+	}
+	return nil
+}
+
+// jsonList encodes paths as a single line JSON array
+func jsonList(paths []string) string {
+	if paths == nil {
+		paths = []string{}
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(paths)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
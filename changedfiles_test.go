@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportChangedFiles(t *testing.T) {
+	dir := newTestRepo(t)
+	before := commitTestFile(t, dir, "old.txt", "some content\nthat is long enough\nto be detected as renamed\n", "old")
+	gitCmd(t, dir, "mv", "old.txt", "new.txt")
+	writeTestFile(t, dir, "README.md", "changed\n")
+	writeTestFile(t, dir, "src/main.go", "package main\n")
+	head := commitTestFile(t, dir, "docs/guide.md", "guide\n", "changes")
+
+	file := filepath.Join(t.TempDir(), "changed-files.json")
+	setTestEnv(t, map[string]string{
+		"DRONE_BUILD_EVENT":         "push",
+		"DRONE_COMMIT_BEFORE":       before,
+		"PLUGIN_CHANGED_FILES_FILE": file,
+	})
+
+	outputs, _ := runPostCloneIn(t, dir)
+	assert.Equal(t, map[string]string{
+		"CHANGED_FILES":       `["README.md","docs/guide.md","new.txt","src/main.go"]`,
+		"CHANGED_FILES_COUNT": "4",
+		"CHANGED_FILES_BASE":  before,
+		"CHANGED_FILES_HEAD":  head,
+		"CHANGED_FILES_FILE":  file,
+		"ADDED_FILES":         `["docs/guide.md","src/main.go"]`,
+		"MODIFIED_FILES":      `["README.md"]`,
+		"DELETED_FILES":       `[]`,
+		"RENAMED_FILES":       `["new.txt"]`,
+	}, outputs)
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	var doc ChangedFiles
+	require.NoError(t, json.Unmarshal(data, &doc))
+	assert.Equal(t, ChangedFiles{
+		Event: "push",
+		Base:  before,
+		Head:  head,
+		Files: []ChangedFile{
+			{Path: "README.md", Status: "modified"},
+			{Path: "docs/guide.md", Status: "added"},
+			{Path: "new.txt", Status: "renamed", OldPath: "old.txt"},
+			{Path: "src/main.go", Status: "added"},
+		},
+	}, doc)
+}
+
+func TestExportChangedFiles_Tag(t *testing.T) {
+	dir := newTestRepo(t)
+	setTestEnv(t, map[string]string{
+		"DRONE_BUILD_EVENT":    "tag",
+		"DRONE_COMMIT_REF":     "refs/tags/v1.0.0",
+		"PLUGIN_CHANGED_FILES": "true",
+	})
+
+	outputs, _ := runPostCloneIn(t, dir)
+	assert.Equal(t, "0", outputs["CHANGED_FILES_COUNT"])
+	assert.Equal(t, "[]", outputs["CHANGED_FILES"])
+	assert.NotContains(t, outputs, "CHANGED_FILES_FILE")
+}
+
+func TestExportChangedFiles_SpecialNames(t *testing.T) {
+	dir := newTestRepo(t)
+	before := gitCmd(t, dir, "rev-parse", "HEAD")
+	writeTestFile(t, dir, "a,b.txt", "comma\n")
+	commitTestFile(t, dir, "line\nSKIP=true", "newline\n", "special names")
+
+	setTestEnv(t, map[string]string{
+		"DRONE_BUILD_EVENT":    "push",
+		"DRONE_COMMIT_BEFORE":  before,
+		"PLUGIN_CHANGED_FILES": "true",
+	})
+
+	outputs, _ := runPostCloneIn(t, dir)
+	var files []string
+	require.NoError(t, json.Unmarshal([]byte(outputs["CHANGED_FILES"]), &files))
+	assert.Equal(t, []string{"a,b.txt", "line\nSKIP=true"}, files)
+	assert.NotContains(t, outputs, "SKIP")
+}
+
+func TestExportChangedFiles_UnknownBefore(t *testing.T) {
+	dir := newTestRepo(t)
+	setTestEnv(t, map[string]string{
+		"DRONE_BUILD_EVENT":    "push",
+		"DRONE_COMMIT_BEFORE":  "0123456789abcdef0123456789abcdef01234567",
+		"PLUGIN_CHANGED_FILES": "true",
+	})
+
+	// a force push whose previous commit cannot be fetched does not fail the clone
+	outputs, _ := runPostCloneIn(t, dir)
+	assert.Equal(t, "0", outputs["CHANGED_FILES_COUNT"])
+	assert.Equal(t, "[]", outputs["CHANGED_FILES"])
+}
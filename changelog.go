@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Merge commits of GitHub, Bitbucket and GitLab
+	mergePullRequest = regexp.MustCompile(`^Merge pull request #(\d+)|^Merged in .*\(pull request #(\d+)\)`)
+	mergeRequest     = regexp.MustCompile(`(?m)^See merge request \S*!(\d+)$`)
+	// Squash merges append the pull request number to the subject
+	squashPullRequest = regexp.MustCompile(`\(#(\d+)\)$`)
+)
+
+// changelogSections lists the sections of the changelog in order. Commits
+// whose type is not listed end up in the last section.
+var changelogSections = []struct {
+	title string
+	types []string
+}{
+	{"Features", []string{"feat"}},
+	{"Bug Fixes", []string{"fix"}},
+	{"Performance Improvements", []string{"perf"}},
+	{"Reverts", []string{"revert"}},
+	{"Documentation", []string{"docs"}},
+	{"Refactoring", []string{"refactor"}},
+	{"Other Changes", nil},
+}
+
+// ChangelogEntry is a commit listed in the changelog
+type ChangelogEntry struct {
+	SHA         string `json:"sha"`
+	Type        string `json:"type,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+	Breaking    bool   `json:"breaking,omitempty"`
+	Description string `json:"description"`
+	Author      string `json:"author"`
+	Email       string `json:"email"`
+	PullRequest int    `json:"pull_request,omitempty"`
+}
+
+// Changelog lists the commits between the previous release tag and the tag
+// being built
+type Changelog struct {
+	Tag         string           `json:"tag"`
+	PreviousTag string           `json:"previous_tag,omitempty"`
+	Commits     []ChangelogEntry `json:"commits"`
+}
+
+// changelogEnabled reports whether a changelog should be generated
+func changelogEnabled() bool {
+	return os.Getenv("PLUGIN_CHANGELOG_FILE") != "" || os.Getenv("PLUGIN_CHANGELOG_JSON_FILE") != ""
+}
+
+// generateChangelog collects the commits between the previous release tag
+// and HEAD, deepening shallow history until the previous tag is found. Merge
+// commits are not listed themselves, their pull request number is attached to
+// the commits they merged instead.
+func generateChangelog(ctx context.Context, dir string) (*Changelog, error) {
+	tag := os.Getenv("DRONE_TAG")
+	if tag == "" {
+		tag = strings.TrimPrefix(os.Getenv("DRONE_COMMIT_REF"), "refs/tags/")
+	}
+	prefix := os.Getenv("PLUGIN_SEMVER_TAG_PREFIX")
+
+	var refspecs []string
+	if tag != "" {
+		refspecs = append(refspecs, fmt.Sprintf("+refs/tags/%s:refs/tags/%s", tag, tag))
+	}
+
+	if err := fetchTags(ctx, dir); err != nil {
+		return nil, err
+	}
+
+	var previous string
+	var err error
+	check := func() bool {
+		// Tags pointing at HEAD, such as the one being built, are not candidates
+		previous, _, err = latestVersionTag(ctx, dir, prefix, "--no-contains", "HEAD")
+		return err != nil || previous != ""
+	}
+	if deepenErr := deepenUntil(ctx, dir, refspecs, false, check); deepenErr != nil {
+		return nil, deepenErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	revs := []string{"HEAD"}
+	if previous != "" {
+		revs = []string{"HEAD", "^refs/tags/" + previous}
+	}
+	args := append([]string{"log", "-z", "--format=%H%x00%P%x00%an%x00%ae%x00%B"}, revs...)
+	out, err := runGit(ctx, dir, append(args, "--")...)
+	if err != nil {
+		return nil, err
+	}
+
+	changelog := &Changelog{Tag: tag, PreviousTag: previous, Commits: []ChangelogEntry{}}
+	fields := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	pullRequests := make(map[string]int)
+	var entries []ChangelogEntry
+
+	for i := 0; i+5 <= len(fields) && out != ""; i += 5 {
+		sha, parents, message := fields[i], strings.Fields(fields[i+1]), strings.TrimSpace(fields[i+4])
+		subject, _, _ := strings.Cut(message, "\n")
+
+		if len(parents) > 1 {
+			if pr := mergeNumber(message); pr != 0 {
+				// Attach the pull request to the commits brought in by the merge
+				merged, err := runGit(ctx, dir, "rev-list", parents[0]+".."+sha)
+				if err != nil {
+					return nil, err
+				}
+				for _, commit := range strings.Fields(merged) {
+					if _, ok := pullRequests[commit]; !ok {
+						pullRequests[commit] = pr
+					}
+				}
+			}
+			continue
+		}
+
+		entry := ChangelogEntry{SHA: sha, Description: subject, Author: fields[i+2], Email: fields[i+3]}
+		if match := squashPullRequest.FindStringSubmatch(subject); match != nil {
+			entry.PullRequest, _ = strconv.Atoi(match[1])
+		}
+		if commit, ok := parseConventionalCommit(message); ok {
+			entry.Type, entry.Scope, entry.Breaking, entry.Description =
+				commit.Type, commit.Scope, commit.Breaking, commit.Description
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, entry := range entries {
+		if entry.PullRequest == 0 {
+			entry.PullRequest = pullRequests[entry.SHA]
+		}
+		changelog.Commits = append(changelog.Commits, entry)
+	}
+	return changelog, nil
+}
+
+// mergeNumber returns the pull request number of a merge commit message
+func mergeNumber(message string) int {
+	var number string
+	if match := mergePullRequest.FindStringSubmatch(message); match != nil {
+		number = match[1] + match[2]
+	} else if match := mergeRequest.FindStringSubmatch(message); match != nil {
+		number = match[1]
+	}
+	n, _ := strconv.Atoi(number)
+	return n
+}
+
+// Markdown renders the changelog grouped by conventional commit type
+func (c *Changelog) Markdown() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "## %s\n", c.Tag)
+	if c.PreviousTag != "" {
+		fmt.Fprintf(&sb, "\nChanges since %s\n", c.PreviousTag)
+	}
+
+	var breaking []ChangelogEntry
+	for _, entry := range c.Commits {
+		if entry.Breaking {
+			breaking = append(breaking, entry)
+		}
+	}
+	writeChangelogSection(&sb, "Breaking Changes", breaking)
+
+	for i, section := range changelogSections {
+		var entries []ChangelogEntry
+		for _, entry := range c.Commits {
+			if changelogSection(entry.Type) == i {
+				entries = append(entries, entry)
+			}
+		}
+		writeChangelogSection(&sb, section.title, entries)
+	}
+	return sb.String()
+}
+
+// changelogSection returns the index of the section listing commits of type t
+func changelogSection(t string) int {
+	for i, section := range changelogSections {
+		for _, sectionType := range section.types {
+			if sectionType == t {
+				return i
+			}
+		}
+	}
+	return len(changelogSections) - 1
+}
+
+func writeChangelogSection(sb *strings.Builder, title string, entries []ChangelogEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	fmt.Fprintf(sb, "\n### %s\n\n", title)
+	for _, entry := range entries {
+		sb.WriteString("- ")
+		if entry.Scope != "" {
+			fmt.Fprintf(sb, "**%s:** ", entry.Scope)
+		}
+		sb.WriteString(entry.Description)
+		if entry.PullRequest != 0 && !strings.HasSuffix(entry.Description, fmt.Sprintf("(#%d)", entry.PullRequest)) {
+			fmt.Fprintf(sb, " (#%d)", entry.PullRequest)
+		}
+		fmt.Fprintf(sb, " by %s (%.7s)\n", entry.Author, entry.SHA)
+	}
+}
+
+// writeChangelog writes the changelog to PLUGIN_CHANGELOG_FILE as Markdown and
+// to PLUGIN_CHANGELOG_JSON_FILE as JSON
+func writeChangelog(changelog *Changelog) error {
+	if file := os.Getenv("PLUGIN_CHANGELOG_FILE"); file != "" {
+		if err := os.WriteFile(file, []byte(changelog.Markdown()), 0644); err != nil {
+			return fmt.Errorf("failed to write changelog %s: %v", file, err)
+		}
+	}
+	if file := os.Getenv("PLUGIN_CHANGELOG_JSON_FILE"); file != "" {
+		data, err := json.MarshalIndent(changelog, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal changelog: %v", err)
+		}
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			return fmt.Errorf("failed to write changelog %s: %v", file, err)
+		}
+	}
+	return nil
+}
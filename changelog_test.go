@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeNumber(t *testing.T) {
+	assert.Equal(t, 12, mergeNumber("Merge pull request #12 from octo/feature\n\nfeat: thing"))
+	assert.Equal(t, 7, mergeNumber("Merged in feature (pull request #7)\n\nthing"))
+	assert.Equal(t, 45, mergeNumber("Merge branch 'feature' into 'main'\n\nThing\n\nSee merge request group/project!45"))
+	assert.Equal(t, 0, mergeNumber("Merge branch 'main' into feature"))
+}
+
+func TestGenerateChangelog(t *testing.T) {
+	remote := newTestRepo(t)
+	gitCmd(t, remote, "tag", "v1.0.0")
+	commitTestFile(t, remote, "a.txt", "a\n", "fix(api): handle empty body")
+
+	gitCmd(t, remote, "checkout", "-q", "-b", "feature")
+	feature := commitTestFile(t, remote, "b.txt", "b\n", "feat: add search")
+	gitCmd(t, remote, "checkout", "-q", "main")
+	gitCmd(t, remote, "merge", "-q", "--no-ff", "-m", "Merge pull request #12 from octo/feature", "feature")
+
+	commitTestFile(t, remote, "c.txt", "c\n", "feat!: drop the v1 config (#15)")
+	commitTestFile(t, remote, "d.txt", "d\n", "Update README")
+	gitCmd(t, remote, "tag", "v2.0.0")
+
+	// Tag builds fetch the tag with the configured depth
+	dir := t.TempDir()
+	gitCmd(t, dir, "init", "-q")
+	gitCmd(t, dir, "remote", "add", "origin", "file://"+remote)
+	gitCmd(t, dir, "fetch", "-q", "--depth=1", "origin", "+refs/tags/v2.0.0:")
+	gitCmd(t, dir, "checkout", "-q", "FETCH_HEAD")
+
+	t.Setenv("DRONE_TAG", "v2.0.0")
+
+	changelog, err := generateChangelog(context.Background(), dir)
+	require.NoError(t, err)
+	assert.Equal(t, "v2.0.0", changelog.Tag)
+	assert.Equal(t, "v1.0.0", changelog.PreviousTag)
+	require.Len(t, changelog.Commits, 4)
+
+	byDescription := make(map[string]ChangelogEntry)
+	for _, entry := range changelog.Commits {
+		byDescription[entry.Description] = entry
+	}
+	assert.Equal(t, ChangelogEntry{
+		SHA: feature, Type: "feat", Description: "add search",
+		Author: "drone", Email: "drone@localhost", PullRequest: 12,
+	}, byDescription["add search"])
+	assert.True(t, byDescription["drop the v1 config (#15)"].Breaking)
+	assert.Equal(t, 15, byDescription["drop the v1 config (#15)"].PullRequest)
+	assert.Equal(t, "api", byDescription["handle empty body"].Scope)
+	assert.Equal(t, "", byDescription["Update README"].Type)
+
+	markdown := changelog.Markdown()
+	assert.Contains(t, markdown, "## v2.0.0\n\nChanges since v1.0.0\n")
+	assert.Contains(t, markdown, "### Breaking Changes\n\n- drop the v1 config (#15) by drone (")
+	assert.Contains(t, markdown, "- add search (#12) by drone ("+feature[:7]+")\n")
+	assert.Contains(t, markdown, "### Bug Fixes\n\n- **api:** handle empty body by drone (")
+	assert.Contains(t, markdown, "### Other Changes\n\n- Update README by drone (")
+	assert.NotContains(t, markdown, "Merge pull request")
+}
+
+func TestGenerateChangelog_FullClone(t *testing.T) {
+	remote := newTestRepo(t)
+	gitCmd(t, remote, "tag", "v1.0.0")
+	commitTestFile(t, remote, "a.txt", "a\n", "feat: add search")
+	gitCmd(t, remote, "tag", "v1.1.0")
+
+	// A full depth clone of the tag, which does not follow the other tags
+	dir := t.TempDir()
+	gitCmd(t, dir, "init", "-q")
+	gitCmd(t, dir, "remote", "add", "origin", "file://"+remote)
+	gitCmd(t, dir, "fetch", "-q", "origin", "+refs/tags/v1.1.0:")
+	gitCmd(t, dir, "checkout", "-q", "FETCH_HEAD")
+
+	t.Setenv("DRONE_TAG", "v1.1.0")
+
+	changelog, err := generateChangelog(context.Background(), dir)
+	require.NoError(t, err)
+	assert.Equal(t, "v1.0.0", changelog.PreviousTag)
+	require.Len(t, changelog.Commits, 1)
+	assert.Equal(t, "add search", changelog.Commits[0].Description)
+}
+
+func TestRunPostClone_Changelog(t *testing.T) {
+	dir := newTestRepo(t)
+	gitCmd(t, dir, "tag", "v0.1.0")
+
+	out := t.TempDir()
+	setTestEnv(t, map[string]string{
+		"DRONE_BUILD_EVENT":          "tag",
+		"DRONE_COMMIT_REF":           "refs/tags/v0.1.0",
+		"DRONE_TAG":                  "v0.1.0",
+		"PLUGIN_CHANGELOG_FILE":      filepath.Join(out, "CHANGELOG.md"),
+		"PLUGIN_CHANGELOG_JSON_FILE": filepath.Join(out, "changelog.json"),
+	})
+
+	outputs, _ := runPostCloneIn(t, dir)
+	assert.Equal(t, "", outputs["CHANGELOG_PREVIOUS_TAG"])
+
+	markdown, err := os.ReadFile(filepath.Join(out, "CHANGELOG.md"))
+	require.NoError(t, err)
+	assert.Contains(t, string(markdown), "### Other Changes\n\n- initial commit by drone")
+
+	data, err := os.ReadFile(filepath.Join(out, "changelog.json"))
+	require.NoError(t, err)
+	var changelog Changelog
+	require.NoError(t, json.Unmarshal(data, &changelog))
+	assert.Equal(t, "v0.1.0", changelog.Tag)
+	assert.Len(t, changelog.Commits, 1)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// initialDeepen is the number of commits fetched the first time a
+	// shallow repository lacks the history needed to compute the changes.
+	// It doubles on every attempt until maxDeepen, after which the
+	// remaining history is fetched at once, or the release tag search
+	// gives up.
+	initialDeepen = 64
+	maxDeepen     = 4096
+
+	zeroSHA = "0000000000000000000000000000000000000000"
+)
+
+// emptyTrees maps the repository object format to the hash of the empty tree,
+// which is used as the base of a root commit
+var emptyTrees = map[string]string{
+	"sha1":   "4b825dc642cb6eb9a060e54bf8d69288fbee4904",
+	"sha256": "6ef19b41225c5369f1c104d45d8d85efa9b057b53b14b4b9b939dd74decc5321",
+}
+
+// ChangedFile is a file changed by the build
+type ChangedFile struct {
+	Path    string `json:"path"`
+	Status  string `json:"status"`
+	OldPath string `json:"old_path,omitempty"`
+}
+
+// ChangeRange describes the two commits compared to compute the changes of
+// the build
+type ChangeRange struct {
+	Base string `json:"base"`
+	Head string `json:"head"`
+}
+
+// cloneType mirrors the CLONE_TYPE detection of the clone scripts
+func cloneType() string {
+	ref := os.Getenv("DRONE_COMMIT_REF")
+	switch {
+	case strings.HasPrefix(ref, "refs/tags/"):
+		return "tag"
+	case strings.HasPrefix(ref, "refs/pull/"),
+		strings.HasPrefix(ref, "refs/pull-request/"),
+		strings.HasPrefix(ref, "refs/merge-requests/"):
+		return "pull_request"
+	}
+	return os.Getenv("DRONE_BUILD_EVENT")
+}
+
+// resolveChangeRange determines the commits to compare for the build. Push
+// builds compare DRONE_COMMIT_BEFORE (or the first parent when the branch is
+// new) with the checked out commit, pull requests compare the merge base of
+// the target branch with the pull request head. Shallow history is deepened
+// as needed. A nil range is returned for builds without meaningful changes,
+// such as tags.
+func resolveChangeRange(ctx context.Context, dir string) (*ChangeRange, error) {
+	head, err := runGit(ctx, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	switch cloneType() {
+	case "pull_request":
+		return resolvePullRequestRange(ctx, dir, head)
+	case "push":
+		return resolvePushRange(ctx, dir, head)
+	default:
+		return nil, nil
+	}
+}
+
+func resolvePushRange(ctx context.Context, dir, head string) (*ChangeRange, error) {
+	var refspecs []string
+	if branch := os.Getenv("DRONE_COMMIT_BRANCH"); branch != "" {
+		refspecs = append(refspecs, fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", branch, branch))
+	}
+
+	before := os.Getenv("DRONE_COMMIT_BEFORE")
+	if before != "" && before != zeroSHA && before != head {
+		if err := deepenUntil(ctx, dir, refspecs, true, func() bool { return hasCommit(ctx, dir, before) }); err != nil {
+			return nil, err
+		}
+		// The previous commit is not part of the history after a force push
+		if !hasCommit(ctx, dir, before) {
+			if err := runGitTraced(ctx, dir, "fetch", "origin", before); err != nil {
+				return nil, fmt.Errorf("cannot fetch previous commit %s: %v", before, err)
+			}
+		}
+		return &ChangeRange{Base: before, Head: head}, nil
+	}
+
+	// A new branch has no previous commit, fall back to the changes of the
+	// checked out commit
+	parent := head + "^1"
+	if err := deepenUntil(ctx, dir, refspecs, true, func() bool { return hasCommit(ctx, dir, parent) }); err != nil {
+		return nil, err
+	}
+	if base, err := runGit(ctx, dir, "rev-parse", "--verify", "-q", parent); err == nil {
+		return &ChangeRange{Base: base, Head: head}, nil
+	}
+
+	format, err := runGit(ctx, dir, "rev-parse", "--show-object-format")
+	if err != nil {
+		format = "sha1" // Older git versions only support sha1
+	}
+	return &ChangeRange{Base: emptyTrees[format], Head: head}, nil
+}
+
+func resolvePullRequestRange(ctx context.Context, dir, head string) (*ChangeRange, error) {
+	if sha := os.Getenv("DRONE_COMMIT_SHA"); sha != "" && hasCommit(ctx, dir, sha) {
+		head = sha // The checked out commit may be the merge with the target branch
+	}
+
+	target := os.Getenv("DRONE_TARGET_BRANCH")
+	if target == "" {
+		target = os.Getenv("DRONE_COMMIT_BRANCH")
+	}
+	if target == "" {
+		return nil, fmt.Errorf("cannot determine the pull request target branch")
+	}
+
+	targetRef := "refs/remotes/origin/" + target
+	refspecs := []string{fmt.Sprintf("+refs/heads/%s:%s", target, targetRef)}
+	if ref := os.Getenv("DRONE_COMMIT_REF"); ref != "" {
+		refspecs = append(refspecs, ref)
+	}
+
+	// The source branch clone strategy does not fetch the target branch
+	if !hasCommit(ctx, dir, targetRef) {
+		args := []string{"fetch"}
+		if isShallow(ctx, dir) && os.Getenv("PLUGIN_DEPTH") != "" {
+			args = append(args, "--depth="+os.Getenv("PLUGIN_DEPTH"))
+		}
+		args = append(args, "origin", refspecs[0])
+		if err := runGitTraced(ctx, dir, args...); err != nil {
+			return nil, err
+		}
+	}
+
+	var base string
+	err := deepenUntil(ctx, dir, refspecs, true, func() bool {
+		var err error
+		base, err = runGit(ctx, dir, "merge-base", targetRef, head)
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if base == "" {
+		return nil, fmt.Errorf("no merge base between %s and %s", target, head)
+	}
+	return &ChangeRange{Base: base, Head: head}, nil
+}
+
+// deepenUntil fetches more history for refspecs until check succeeds or the
+// repository is no longer shallow. Past maxDeepen the remaining history is
+// fetched at once when unshallow is set, otherwise it gives up. Without
+// refspecs nothing is fetched unless unshallow is set, since the default
+// refspec fetches every branch.
+func deepenUntil(ctx context.Context, dir string, refspecs []string, unshallow bool, check func() bool) error {
+	for depth := initialDeepen; !check(); depth *= 2 {
+		if !isShallow(ctx, dir) || !unshallow && (len(refspecs) == 0 || depth > maxDeepen) {
+			return nil
+		}
+
+		args := []string{"fetch"}
+		if depth > maxDeepen {
+			args = append(args, "--unshallow")
+		} else {
+			args = append(args, fmt.Sprintf("--deepen=%d", depth))
+		}
+		args = append(args, "origin")
+		args = append(args, refspecs...)
+		if err := runGitTraced(ctx, dir, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchTags fetches the tags of origin, which the branch and commit fetches
+// of the clone scripts do not follow. A shallow repository only fetches the
+// tagged commits, deepenUntil connects them to HEAD when needed.
+func fetchTags(ctx context.Context, dir string) error {
+	if _, err := runGit(ctx, dir, "remote", "get-url", "origin"); err != nil {
+		return nil // Not cloned from a remote
+	}
+	args := []string{"fetch", "--no-recurse-submodules"}
+	if isShallow(ctx, dir) {
+		args = append(args, "--depth=1")
+	}
+	args = append(args, "origin", "+refs/tags/*:refs/tags/*")
+	if err := runGitTraced(ctx, dir, args...); err != nil {
+		return fmt.Errorf("failed to fetch tags: %v", err)
+	}
+	return nil
+}
+
+func hasCommit(ctx context.Context, dir, rev string) bool {
+	_, err := runGit(ctx, dir, "rev-parse", "--verify", "-q", rev+"^{commit}")
+	return err == nil
+}
+
+func isShallow(ctx context.Context, dir string) bool {
+	out, err := runGit(ctx, dir, "rev-parse", "--is-shallow-repository")
+	return err == nil && out == "true"
+}
+
+// diffChangedFiles lists the files that differ between the commits of r
+func diffChangedFiles(ctx context.Context, dir string, r *ChangeRange) ([]ChangedFile, error) {
+	out, err := runGit(ctx, dir, "diff-tree", "-r", "-z", "-M", "--name-status", r.Base, r.Head)
+	if err != nil {
+		return nil, err
+	}
+	return parseNameStatus(out), nil
+}
+
+// parseNameStatus parses the NUL separated output of git diff --name-status -z
+func parseNameStatus(out string) []ChangedFile {
+	fields := strings.Split(strings.TrimRight(out, "\x00"), "\x00")
+	var files []ChangedFile
+
+	for i := 0; i < len(fields) && fields[i] != ""; {
+		status := fields[i]
+		i++
+
+		switch status[0] {
+		case 'R', 'C':
+			if i+1 >= len(fields) {
+				return files
+			}
+			files = append(files, ChangedFile{Path: fields[i+1], OldPath: fields[i], Status: changeStatus(status[0])})
+			i += 2
+		default:
+			if i >= len(fields) {
+				return files
+			}
+			files = append(files, ChangedFile{Path: fields[i], Status: changeStatus(status[0])})
+			i++
+		}
+	}
+	return files
+}
+
+func changeStatus(code byte) string {
+	switch code {
+	case 'A':
+		return "added"
+	case 'M':
+		return "modified"
+	case 'D':
+		return "deleted"
+	case 'R':
+		return "renamed"
+	case 'C':
+		return "copied"
+	case 'T':
+		return "type_changed"
+	default:
+		return "unknown"
+	}
+}
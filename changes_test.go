@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNameStatus(t *testing.T) {
+	out := "M\x00main.go\x00A\x00docs/new file.md\x00R087\x00old.go\x00new.go\x00D\x00gone.txt\x00"
+
+	files := parseNameStatus(out)
+	assert.Equal(t, []ChangedFile{
+		{Path: "main.go", Status: "modified"},
+		{Path: "docs/new file.md", Status: "added"},
+		{Path: "new.go", OldPath: "old.go", Status: "renamed"},
+		{Path: "gone.txt", Status: "deleted"},
+	}, files)
+
+	assert.Empty(t, parseNameStatus(""))
+}
+
+func TestResolveChangeRange_Push(t *testing.T) {
+	remote := newTestRepo(t)
+	before := gitCmd(t, remote, "rev-parse", "HEAD")
+	commitTestFile(t, remote, "a.txt", "a\n", "add a")
+	commitTestFile(t, remote, "b.txt", "b\n", "add b")
+	head := commitTestFile(t, remote, "README.md", "changed\n", "change readme")
+
+	// A shallow clone does not contain the previous commit
+	dir := t.TempDir()
+	gitCmd(t, dir, "clone", "-q", "--depth=1", "--branch=main", "file://"+remote, ".")
+
+	setTestEnv(t, map[string]string{
+		"DRONE_BUILD_EVENT":   "push",
+		"DRONE_COMMIT_BRANCH": "main",
+		"DRONE_COMMIT_BEFORE": before,
+		"DRONE_COMMIT_SHA":    head,
+	})
+
+	ctx := context.Background()
+	r, err := resolveChangeRange(ctx, dir)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, before, r.Base)
+	assert.Equal(t, head, r.Head)
+
+	files, err := diffChangedFiles(ctx, dir, r)
+	require.NoError(t, err)
+	assert.Equal(t, []ChangedFile{
+		{Path: "README.md", Status: "modified"},
+		{Path: "a.txt", Status: "added"},
+		{Path: "b.txt", Status: "added"},
+	}, files)
+}
+
+func TestResolveChangeRange_NewBranch(t *testing.T) {
+	remote := newTestRepo(t)
+	parent := gitCmd(t, remote, "rev-parse", "HEAD")
+	head := commitTestFile(t, remote, "a.txt", "a\n", "add a")
+
+	dir := t.TempDir()
+	gitCmd(t, dir, "clone", "-q", "--depth=1", "--branch=main", "file://"+remote, ".")
+
+	setTestEnv(t, map[string]string{
+		"DRONE_BUILD_EVENT":   "push",
+		"DRONE_COMMIT_BRANCH": "main",
+		"DRONE_COMMIT_BEFORE": zeroSHA,
+	})
+
+	r, err := resolveChangeRange(context.Background(), dir)
+	require.NoError(t, err)
+	assert.Equal(t, &ChangeRange{Base: parent, Head: head}, r)
+
+	// The root commit is compared with the empty tree
+	root := newTestRepo(t)
+	r, err = resolveChangeRange(context.Background(), root)
+	require.NoError(t, err)
+	assert.Equal(t, emptyTrees["sha1"], r.Base)
+}
+
+func TestResolveChangeRange_PullRequest(t *testing.T) {
+	remote := newTestRepo(t)
+	commitTestFile(t, remote, "base.txt", "base\n", "base")
+	fork := gitCmd(t, remote, "rev-parse", "HEAD")
+
+	gitCmd(t, remote, "checkout", "-q", "-b", "feature")
+	commitTestFile(t, remote, "feature/a.txt", "a\n", "feature a")
+	head := commitTestFile(t, remote, "feature/b.txt", "b\n", "feature b")
+	gitCmd(t, remote, "update-ref", "refs/pull/7/head", head)
+
+	// The target branch moves on after the pull request was opened
+	gitCmd(t, remote, "checkout", "-q", "main")
+	for _, name := range []string{"c.txt", "d.txt", "e.txt"} {
+		commitTestFile(t, remote, name, name, "main "+name)
+	}
+
+	// Source branch strategy with depth 1: neither the target branch nor
+	// the merge base are present
+	dir := t.TempDir()
+	gitCmd(t, dir, "init", "-q")
+	gitCmd(t, dir, "remote", "add", "origin", "file://"+remote)
+	gitCmd(t, dir, "fetch", "-q", "--depth=1", "origin", "refs/pull/7/head")
+	gitCmd(t, dir, "checkout", "-q", head)
+
+	setTestEnv(t, map[string]string{
+		"DRONE_BUILD_EVENT":   "pull_request",
+		"DRONE_COMMIT_REF":    "refs/pull/7/head",
+		"DRONE_COMMIT_BRANCH": "main",
+		"DRONE_COMMIT_SHA":    head,
+		"PLUGIN_DEPTH":        "1",
+	})
+
+	ctx := context.Background()
+	r, err := resolveChangeRange(ctx, dir)
+	require.NoError(t, err)
+	assert.Equal(t, &ChangeRange{Base: fork, Head: head}, r)
+
+	files, err := diffChangedFiles(ctx, dir, r)
+	require.NoError(t, err)
+	assert.Equal(t, []ChangedFile{
+		{Path: "feature/a.txt", Status: "added"},
+		{Path: "feature/b.txt", Status: "added"},
+	}, files)
+}
+
+func TestResolveChangeRange_Tag(t *testing.T) {
+	dir := newTestRepo(t)
+	t.Setenv("DRONE_BUILD_EVENT", "tag")
+	t.Setenv("DRONE_COMMIT_REF", "refs/tags/v1.0.0")
+
+	r, err := resolveChangeRange(context.Background(), dir)
+	require.NoError(t, err)
+	assert.Nil(t, r)
+}
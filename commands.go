@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runSubcommand runs the helper commands that the clone scripts invoke on
+// this binary through DRONE_GIT_BIN. It reports false when name is not a
+// known command, in which case the regular clone runs.
+func runSubcommand(name string, args []string) (int, bool) {
+	var err error
+	switch name {
+	case "post-clone":
+		err = runPostClone()
+	case "credential":
+		err = runCredentialHelper(args, os.Stdin, os.Stdout)
+	case "ssh-proxy":
+		err = runSSHProxy(args, os.Stdin, os.Stdout)
+	default:
+		return 0, false
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1, true
+	}
+	return 0, true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commitFormat prints the fields of CommitMetadata separated by NUL bytes.
+// The message comes last since it is the only field spanning several lines.
+const commitFormat = "%H%x00%P%x00%an%x00%ae%x00%aI%x00%cn%x00%ce%x00%cI%x00%B"
+
+// Signature identifies the author or committer of a commit
+type Signature struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Date  string `json:"date"`
+}
+
+// CommitMetadata describes the checked out commit as recorded in the
+// repository, which may differ from the DRONE_COMMIT_* values of the trigger
+// when a pull request was merged during the clone
+type CommitMetadata struct {
+	SHA       string    `json:"sha"`
+	Parents   []string  `json:"parents"`
+	Author    Signature `json:"author"`
+	Committer Signature `json:"committer"`
+	Message   string    `json:"message"`
+}
+
+// readCommit reads the metadata of rev
+func readCommit(ctx context.Context, dir, rev string) (*CommitMetadata, error) {
+	out, err := runGit(ctx, dir, "show", "-s", "--format="+commitFormat, rev, "--")
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.SplitN(out, "\x00", 9)
+	if len(fields) != 9 {
+		return nil, fmt.Errorf("unexpected git show output for %s", rev)
+	}
+	return &CommitMetadata{
+		SHA:       fields[0],
+		Parents:   strings.Fields(fields[1]),
+		Author:    Signature{Name: fields[2], Email: fields[3], Date: fields[4]},
+		Committer: Signature{Name: fields[5], Email: fields[6], Date: fields[7]},
+		Message:   strings.TrimRight(fields[8], "\n"),
+	}, nil
+}
+
+// Subject returns the first line of the commit message
+func (c *CommitMetadata) Subject() string {
+	subject, _, _ := strings.Cut(c.Message, "\n")
+	return subject
+}
+
+// outputs returns the metadata as step outputs. The full message is base64
+// encoded since output values cannot span several lines.
+func (c *CommitMetadata) outputs() map[string]string {
+	outputs := map[string]string{
+		"COMMIT_SHA":             c.SHA,
+		"COMMIT_PARENTS":         strings.Join(c.Parents, ","),
+		"COMMIT_AUTHOR_NAME":     c.Author.Name,
+		"COMMIT_AUTHOR_EMAIL":    c.Author.Email,
+		"COMMIT_AUTHOR_DATE":     c.Author.Date,
+		"COMMIT_COMMITTER_NAME":  c.Committer.Name,
+		"COMMIT_COMMITTER_EMAIL": c.Committer.Email,
+		"COMMIT_COMMITTER_DATE":  c.Committer.Date,
+		"COMMIT_SUBJECT":         c.Subject(),
+		"COMMIT_MESSAGE_BASE64":  base64.StdEncoding.EncodeToString([]byte(c.Message)),
+	}
+	if date, err := time.Parse(time.RFC3339, c.Committer.Date); err == nil {
+		outputs["COMMIT_TIMESTAMP"] = strconv.FormatInt(date.Unix(), 10)
+	}
+	return outputs
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCommit(t *testing.T) {
+	dir := newTestRepo(t)
+	first := gitCmd(t, dir, "rev-parse", "HEAD")
+	gitCmd(t, dir, "checkout", "-q", "-b", "feature")
+	second := commitTestFile(t, dir, "a.txt", "a\n", "add a")
+	gitCmd(t, dir, "checkout", "-q", "main")
+	commitTestFile(t, dir, "b.txt", "b\n", "add b")
+
+	t.Setenv("GIT_AUTHOR_DATE", "2024-03-01T10:00:00+01:00")
+	t.Setenv("GIT_COMMITTER_DATE", "2024-03-02T12:30:00Z")
+	message := "Merge feature\n\nA body with \"quotes\", commas\nand several lines"
+	gitCmd(t, dir, "merge", "-q", "--no-ff", "-m", message, "feature")
+
+	commit, err := readCommit(context.Background(), dir, "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, gitCmd(t, dir, "rev-parse", "HEAD"), commit.SHA)
+	assert.Len(t, commit.Parents, 2)
+	assert.Equal(t, second, commit.Parents[1])
+	assert.NotEqual(t, first, commit.Parents[0])
+	assert.Equal(t, Signature{Name: "drone", Email: "drone@localhost", Date: "2024-03-01T10:00:00+01:00"}, commit.Author)
+	assert.Equal(t, "2024-03-02T12:30:00+00:00", commit.Committer.Date)
+	assert.Equal(t, message, commit.Message)
+	assert.Equal(t, "Merge feature", commit.Subject())
+
+	outputs := commit.outputs()
+	assert.Equal(t, "1709382600", outputs["COMMIT_TIMESTAMP"])
+	assert.Equal(t, "Merge feature", outputs["COMMIT_SUBJECT"])
+	assert.Equal(t, commit.Parents[0]+","+second, outputs["COMMIT_PARENTS"])
+	decoded, err := base64.StdEncoding.DecodeString(outputs["COMMIT_MESSAGE_BASE64"])
+	require.NoError(t, err)
+	assert.Equal(t, message, string(decoded))
+}
+
+func TestRunPostClone_CommitMetadata(t *testing.T) {
+	dir := newTestRepo(t)
+	head := gitCmd(t, dir, "rev-parse", "HEAD")
+
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	setTestEnv(t, map[string]string{
+		"PLUGIN_COMMIT_METADATA":   "true",
+		"PLUGIN_CLONE_REPORT_FILE": reportFile,
+	})
+
+	outputs, _ := runPostCloneIn(t, dir)
+	assert.Equal(t, head, outputs["COMMIT_SHA"])
+	assert.Equal(t, "", outputs["COMMIT_PARENTS"])
+	assert.Equal(t, "initial commit", outputs["COMMIT_SUBJECT"])
+
+	data, err := os.ReadFile(reportFile)
+	require.NoError(t, err)
+	var report CloneReport
+	require.NoError(t, json.Unmarshal(data, &report))
+	require.NotNil(t, report.Commit)
+	assert.Equal(t, head, report.Commit.SHA)
+	assert.Equal(t, "initial commit", report.Commit.Message)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	conventionalHeader = regexp.MustCompile(`^(\w+)(?:\(([^)]*)\))?(!)?: (.+)$`)
+	breakingFooter     = regexp.MustCompile(`(?m)^BREAKING[ -]CHANGE: `)
+)
+
+// ConventionalCommit is a commit message following the conventional commits
+// specification, e.g. "feat(api)!: drop the v1 endpoints"
+type ConventionalCommit struct {
+	Type        string `json:"type"`
+	Scope       string `json:"scope,omitempty"`
+	Breaking    bool   `json:"breaking,omitempty"`
+	Description string `json:"description"`
+}
+
+// parseConventionalCommit parses the header and footers of message. It
+// reports false when the message does not follow the specification.
+func parseConventionalCommit(message string) (ConventionalCommit, bool) {
+	header, _, _ := strings.Cut(message, "\n")
+	match := conventionalHeader.FindStringSubmatch(strings.TrimSpace(header))
+	if match == nil {
+		return ConventionalCommit{}, false
+	}
+	return ConventionalCommit{
+		Type:        strings.ToLower(match[1]),
+		Scope:       match[2],
+		Breaking:    match[3] == "!" || breakingFooter.MatchString(message),
+		Description: match[4],
+	}, true
+}
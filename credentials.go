@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Credential is a username and secret served for the repositories of a host
+// below an optional path prefix. An empty protocol matches any protocol.
+type Credential struct {
+	Protocol string
+	Host     string
+	Path     string
+	Username string
+	Password string
+}
+
+// CredentialSource is an entry of the credentials list. The secret is a
+// reference to an environment variable or a file so that the list itself
+// does not need to be secret.
+type CredentialSource struct {
+	Host         string `json:"host" yaml:"host"`
+	Path         string `json:"path,omitempty" yaml:"path"`
+	Protocol     string `json:"protocol,omitempty" yaml:"protocol"`
+	Username     string `json:"username" yaml:"username"`
+	PasswordEnv  string `json:"password_env,omitempty" yaml:"password_env"`
+	PasswordFile string `json:"password_file,omitempty" yaml:"password_file"`
+}
+
+// credentialRequest is a request of the git credential helper protocol
+type credentialRequest struct {
+	Protocol string
+	Host     string
+	Path     string
+}
+
+// loadCredentials returns the credentials of the build: DRONE_NETRC_USERNAME
+// and DRONE_NETRC_PASSWORD for DRONE_NETRC_MACHINE, followed by the entries of
+// the credentials list. The netrc machine is only served for the protocol of
+// DRONE_REMOTE_URL. Its secret may be read from the file named by
+// DRONE_NETRC_PASSWORD_FILE instead, so that it never needs to be in the
+// environment.
+func loadCredentials() ([]Credential, error) {
+	var credentials []Credential
+
+	if machine := os.Getenv("DRONE_NETRC_MACHINE"); machine != "" {
+		password, err := readSecret(os.Getenv("DRONE_NETRC_PASSWORD"), "", os.Getenv("DRONE_NETRC_PASSWORD_FILE"))
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, Credential{
+			Protocol: remoteProtocol(os.Getenv("DRONE_REMOTE_URL")),
+			Host:     machine,
+			Username: os.Getenv("DRONE_NETRC_USERNAME"),
+			Password: password,
+		})
+	}
+
+	sources, err := loadCredentialSources()
+	if err != nil {
+		return nil, err
+	}
+	for _, source := range sources {
+		password, err := readSecret("", source.PasswordEnv, source.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("credentials %s: %v", source.Host, err)
+		}
+		credentials = append(credentials, Credential{
+			Protocol: source.Protocol,
+			Host:     source.Host,
+			Path:     strings.Trim(source.Path, "/"),
+			Username: source.Username,
+			Password: password,
+		})
+	}
+	return credentials, nil
+}
+
+// remoteProtocol returns the protocol the credentials of the remote are sent
+// over: http for an http remote, https otherwise, since git LFS of an ssh
+// remote goes through https
+func remoteProtocol(remote string) string {
+	if u, err := url.Parse(remote); err == nil && u.Scheme == "http" {
+		return "http"
+	}
+	return "https"
+}
+
+// loadCredentialSources reads the credentials list from PLUGIN_CREDENTIALS
+// (inline JSON or YAML) or from the file named by PLUGIN_CREDENTIALS_FILE
+func loadCredentialSources() ([]CredentialSource, error) {
+	data := []byte(os.Getenv("PLUGIN_CREDENTIALS"))
+	if file := os.Getenv("PLUGIN_CREDENTIALS_FILE"); file != "" {
+		var err error
+		if data, err = os.ReadFile(file); err != nil {
+			return nil, fmt.Errorf("failed to read credentials file %s: %v", file, err)
+		}
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	var sources []CredentialSource
+	if err := yaml.Unmarshal(data, &sources); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %v", err)
+	}
+
+	for i, source := range sources {
+		switch {
+		case source.Host == "":
+			return nil, fmt.Errorf("credentials %d: host is required", i)
+		case source.Protocol != "" && source.Protocol != "http" && source.Protocol != "https":
+			return nil, fmt.Errorf("credentials %s: unsupported protocol %q", source.Host, source.Protocol)
+		case source.PasswordEnv == "" && source.PasswordFile == "":
+			return nil, fmt.Errorf("credentials %s: password_env or password_file is required", source.Host)
+		case source.PasswordEnv != "" && source.PasswordFile != "":
+			return nil, fmt.Errorf("credentials %s: password_env and password_file are exclusive", source.Host)
+		}
+	}
+	return sources, nil
+}
+
+// readSecret returns value, or the content of the environment variable or the
+// file it is referenced by
+func readSecret(value, env, file string) (string, error) {
+	if env != "" {
+		value = os.Getenv(env)
+		if value == "" {
+			return "", fmt.Errorf("%s is not set", env)
+		}
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password file %s: %v", file, err)
+		}
+		value = strings.TrimRight(string(data), "\r\n")
+	}
+	return value, nil
+}
+
+// matchCredential returns the credential for the request, preferring the
+// longest matching path prefix, or nil when none matches. A credential host
+// without a port matches the host on any port, like a netrc machine.
+func matchCredential(credentials []Credential, req credentialRequest) *Credential {
+	path := "/" + strings.Trim(req.Path, "/")
+	hostname := req.Host
+	if h, _, err := net.SplitHostPort(req.Host); err == nil {
+		hostname = h
+	}
+
+	var best *Credential
+	for i, c := range credentials {
+		if !strings.EqualFold(c.Host, req.Host) && !strings.EqualFold(c.Host, hostname) {
+			continue
+		}
+		if c.Protocol != "" && c.Protocol != req.Protocol {
+			continue
+		}
+		prefix := "/" + strings.Trim(c.Path, "/")
+		if prefix != "/" && path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			continue
+		}
+		if best == nil || len(c.Path) > len(best.Path) {
+			best = &credentials[i]
+		}
+	}
+	return best
+}
+
+// writeNetrc writes a netrc file for the credentials. A netrc machine cannot
+// be scoped to a path, so every host gets the credential with the shortest
+// path prefix.
+func writeNetrc(w io.Writer, credentials []Credential) error {
+	machines := make(map[string]int)
+	var order []string
+	for i, c := range credentials {
+		host := strings.ToLower(c.Host)
+		previous, ok := machines[host]
+		if !ok {
+			order = append(order, host)
+		}
+		if !ok || len(c.Path) < len(credentials[previous].Path) {
+			machines[host] = i
+		}
+	}
+
+	for _, host := range order {
+		c := credentials[machines[host]]
+		if _, err := fmt.Fprintf(w, "machine %s\nlogin %s\npassword %s\n", c.Host, c.Username, c.Password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configureCredentialHeaders sends the credentials as an Authorization header
+// through http.<url>.extraHeader when PLUGIN_CREDENTIAL_HEADERS is set. The
+// headers are passed to the clone scripts through GIT_CONFIG_COUNT. Git adds
+// the headers of every matching URL, so each URL first resets the headers of
+// the less specific ones.
+func configureCredentialHeaders() error {
+	if os.Getenv("PLUGIN_CREDENTIAL_HEADERS") != "true" {
+		return nil
+	}
+
+	credentials, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(credentials, func(i, j int) bool {
+		return len(credentials[i].Path) < len(credentials[j].Path)
+	})
+
+	for _, c := range credentials {
+		protocol := c.Protocol
+		if protocol == "" {
+			protocol = "https"
+		}
+		url := protocol + "://" + c.Host + "/" + c.Path
+		auth := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+		fmt.Printf("[INFO] sending credentials for %s as an Authorization header\n", url)
+		addGitConfigEnv("http."+url+".extraHeader", "")
+		addGitConfigEnv("http."+url+".extraHeader", "Authorization: Basic "+auth)
+	}
+	return nil
+}
+
+// parseCredentialRequest reads the attributes sent by git until a blank line
+func parseCredentialRequest(r io.Reader) (credentialRequest, error) {
+	var req credentialRequest
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		key, value, _ := strings.Cut(line, "=")
+		switch key {
+		case "protocol":
+			req.Protocol = value
+		case "host":
+			req.Host = value
+		case "path":
+			req.Path = value
+		}
+	}
+	return req, scanner.Err()
+}
+
+// runCredentialHelper implements the git credential helper protocol. The
+// credentials are only ever served from memory: store and erase are accepted
+// but nothing is persisted. The netrc operation prints the credentials in the
+// netrc format for the clone scripts. With the cert argument only the
+// passphrase of the TLS client key is served, for http.sslCertPasswordProtected.
+func runCredentialHelper(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 2 && args[0] == "cert" {
+		return runCertCredentialHelper(args[1], stdin, stdout)
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: drone-git credential [cert] <get|store|erase|netrc>")
+	}
+
+	if args[0] == "netrc" {
+		credentials, err := loadCredentials()
+		if err != nil {
+			return err
+		}
+		return writeNetrc(stdout, credentials)
+	}
+
+	req, err := parseCredentialRequest(stdin)
+	if err != nil {
+		return fmt.Errorf("failed to read credential request: %v", err)
+	}
+
+	switch args[0] {
+	case "get":
+		credentials, err := loadCredentials()
+		if err != nil {
+			return err
+		}
+		c := matchCredential(credentials, req)
+		if c == nil {
+			return nil // Let git try the next helper
+		}
+		fmt.Fprintf(stdout, "username=%s\npassword=%s\n", c.Username, c.Password)
+		return nil
+	case "store", "erase":
+		return nil
+	default:
+		return fmt.Errorf("unknown credential operation %q", args[0])
+	}
+}
+
+// runCertCredentialHelper serves PLUGIN_SSL_CLIENT_KEY_PASSPHRASE to the
+// requests git makes for the password of the client certificate
+func runCertCredentialHelper(operation string, stdin io.Reader, stdout io.Writer) error {
+	req, err := parseCredentialRequest(stdin)
+	if err != nil {
+		return fmt.Errorf("failed to read credential request: %v", err)
+	}
+
+	switch operation {
+	case "get":
+		passphrase := os.Getenv("PLUGIN_SSL_CLIENT_KEY_PASSPHRASE")
+		if req.Protocol != "cert" || passphrase == "" {
+			return nil // Let git try the next helper
+		}
+		fmt.Fprintf(stdout, "password=%s\n", passphrase)
+		return nil
+	case "store", "erase":
+		return nil
+	default:
+		return fmt.Errorf("unknown credential operation %q", operation)
+	}
+}
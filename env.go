@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// setEnv returns env with key set to value, replacing any previous value
+func setEnv(env []string, key, value string) []string {
+	env = unsetEnv(env, key)
+	return append(env, key+"="+value)
+}
+
+// unsetEnv returns env without any entry for key
+func unsetEnv(env []string, key string) []string {
+	prefix := key + "="
+	result := env[:0:0]
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, prefix) {
+			result = append(result, kv)
+		}
+	}
+	return result
+}
+
+// addGitConfigEnv adds a git config entry to the environment of the git
+// processes started by this process and the clone scripts
+func addGitConfigEnv(key, value string) {
+	count, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	os.Setenv(fmt.Sprintf("GIT_CONFIG_KEY_%d", count), key)
+	os.Setenv(fmt.Sprintf("GIT_CONFIG_VALUE_%d", count), value)
+	os.Setenv("GIT_CONFIG_COUNT", strconv.Itoa(count+1))
+}
+
+// urlCredentials matches the user information of a URL
+var urlCredentials = regexp.MustCompile(`(://)[^/@]+@`)
+
+// maskURL hides the credentials of the URLs in value, like mask_url of the
+// clone scripts
+func maskURL(value string) string {
+	return urlCredentials.ReplaceAllString(value, "${1}****@")
+}
+
+// remoteHost extracts the host name from a git remote URL, including the
+// scp-like syntax used for ssh remotes (git@host:org/repo.git)
+func remoteHost(remote string) string {
+	if u, err := url.Parse(remote); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	if i := strings.Index(remote, ":"); i > 0 && !strings.Contains(remote[:i], "/") {
+		host := remote[:i]
+		if at := strings.LastIndex(host, "@"); at >= 0 {
+			host = host[at+1:]
+		}
+		return host
+	}
+	return ""
+}
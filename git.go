@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// runGit executes a git command in dir and returns its trimmed standard output
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	trace(cmd)
+
+	if err := cmd.Run(); err != nil {
+		// Some commands such as fsck report problems on stdout
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = strings.TrimSpace(stdout.String())
+		}
+		if msg != "" {
+			return "", fmt.Errorf("git %s failed: %w: %s", gitSubcommand(args), err, msg)
+		}
+		return "", fmt.Errorf("git %s failed: %w", gitSubcommand(args), err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// runGitInput executes a git command in dir with the given standard input and
+// returns its untrimmed standard output
+func runGitInput(ctx context.Context, dir string, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	cmd.Stdin = stdin
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	trace(cmd)
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s failed: %v: %s", gitSubcommand(args), err, msg)
+		}
+		return nil, fmt.Errorf("git %s failed: %v", gitSubcommand(args), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// runGitTraced executes a git command in dir the way the clone scripts do:
+// the command is echoed and its output streamed to the build log
+func runGitTraced(ctx context.Context, dir string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	fmt.Fprintf(os.Stdout, "+ git %s\n", strings.Join(args, " "))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s failed: %v", gitSubcommand(args), err)
+	}
+	return nil
+}
+
+// gitSubcommand returns the git command of args for error messages, skipping
+// the global options such as -c key=value that precede it
+func gitSubcommand(args []string) string {
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-c" || args[i] == "-C":
+			i++
+		case !strings.HasPrefix(args[i], "-"):
+			return args[i]
+		}
+	}
+	return strings.Join(args, " ")
+}
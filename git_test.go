@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRepo creates a git repository with a single commit for tests
+func newTestRepo(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	gitCmd(t, dir, "init", "-q", "-b", "main")
+	writeTestFile(t, dir, "README.md", "hello\n")
+	gitCmd(t, dir, "add", ".")
+	gitCmd(t, dir, "commit", "-q", "-m", "initial commit")
+	return dir
+}
+
+// gitCmd runs a git command for test setup and returns its trimmed output
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=drone",
+		"GIT_AUTHOR_EMAIL=drone@localhost",
+		"GIT_COMMITTER_NAME=drone",
+		"GIT_COMMITTER_EMAIL=drone@localhost",
+	)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, "git %v: %s", args, out)
+	return strings.TrimSpace(string(out))
+}
+
+func writeTestFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestRunGit(t *testing.T) {
+	dir := newTestRepo(t)
+
+	out, err := runGit(context.Background(), dir, "rev-parse", "--abbrev-ref", "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, "main", out)
+
+	_, err = runGit(context.Background(), dir, "rev-parse", "--verify", "does-not-exist")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "git rev-parse failed")
+
+	_, err = runGit(context.Background(), dir, "-c", "safe.directory=*", "rev-parse", "--verify", "does-not-exist")
+	assert.Contains(t, err.Error(), "git rev-parse failed")
+}
+
+// commitTestFile writes a file and commits it, returning the new commit sha
+func commitTestFile(t *testing.T, dir, name, content, message string) string {
+	t.Helper()
+
+	writeTestFile(t, dir, name, content)
+	gitCmd(t, dir, "add", "-A")
+	gitCmd(t, dir, "commit", "-q", "-m", message)
+	return gitCmd(t, dir, "rev-parse", "HEAD")
+}
+
+// setTestEnv sets environment variables for the duration of the test
+func setTestEnv(t *testing.T, vars map[string]string) {
+	t.Helper()
+
+	for key, value := range vars {
+		t.Setenv(key, value)
+	}
+}
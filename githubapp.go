@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// githubAppUser is the username GitHub expects with an installation token
+const githubAppUser = "x-access-token"
+
+// GitHubApp holds the credentials of a GitHub App installation
+type GitHubApp struct {
+	AppID          string
+	InstallationID string
+	PrivateKey     *rsa.PrivateKey
+	APIURL         string
+	Client         *http.Client
+}
+
+// installationToken is the response of the access token endpoint
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// configureGitHubApp exchanges the GitHub App credentials for an installation
+// token and exposes it to the clone scripts as the netrc credentials. It is a
+// no-op when PLUGIN_GITHUB_APP_ID is not set.
+func configureGitHubApp(ctx context.Context) error {
+	appID := os.Getenv("PLUGIN_GITHUB_APP_ID")
+	if appID == "" {
+		return nil
+	}
+
+	installationID := os.Getenv("PLUGIN_GITHUB_APP_INSTALLATION_ID")
+	if installationID == "" {
+		return fmt.Errorf("PLUGIN_GITHUB_APP_INSTALLATION_ID is required with PLUGIN_GITHUB_APP_ID")
+	}
+
+	pemData := []byte(os.Getenv("PLUGIN_GITHUB_APP_PRIVATE_KEY"))
+	if file := os.Getenv("PLUGIN_GITHUB_APP_PRIVATE_KEY_FILE"); file != "" {
+		var err error
+		if pemData, err = os.ReadFile(file); err != nil {
+			return fmt.Errorf("failed to read GitHub App private key %s: %v", file, err)
+		}
+	}
+	if len(pemData) == 0 {
+		return fmt.Errorf("PLUGIN_GITHUB_APP_PRIVATE_KEY or PLUGIN_GITHUB_APP_PRIVATE_KEY_FILE is required with PLUGIN_GITHUB_APP_ID")
+	}
+	key, err := parseRSAPrivateKey(pemData)
+	if err != nil {
+		return fmt.Errorf("invalid GitHub App private key: %v", err)
+	}
+
+	host := remoteHost(os.Getenv("DRONE_REMOTE_URL"))
+	app := &GitHubApp{
+		AppID:          appID,
+		InstallationID: installationID,
+		PrivateKey:     key,
+		APIURL:         os.Getenv("PLUGIN_GITHUB_APP_API_URL"),
+		Client:         remoteHTTPClient(30 * time.Second),
+	}
+	if app.APIURL == "" {
+		app.APIURL = githubAPIURL(host)
+	}
+
+	token, err := app.InstallationToken(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[INFO] using GitHub App %s installation token for %s, expires at %s\n",
+		appID, host, token.ExpiresAt.Format(time.RFC3339))
+
+	// The scripts do not need the private key
+	os.Unsetenv("PLUGIN_GITHUB_APP_PRIVATE_KEY")
+
+	if os.Getenv("DRONE_NETRC_MACHINE") == "" {
+		os.Setenv("DRONE_NETRC_MACHINE", host)
+	}
+	os.Setenv("DRONE_NETRC_USERNAME", githubAppUser)
+	os.Setenv("DRONE_NETRC_PASSWORD", token.Token)
+	return nil
+}
+
+// githubAPIURL returns the REST API URL of the GitHub instance serving host
+func githubAPIURL(host string) string {
+	if host == "" || host == "github.com" {
+		return "https://api.github.com"
+	}
+	return "https://" + host + "/api/v3" // GitHub Enterprise Server
+}
+
+// InstallationToken exchanges a JWT signed with the app private key for a
+// short-lived installation access token
+func (a *GitHubApp) InstallationToken(ctx context.Context) (*installationToken, error) {
+	jwt, err := a.signJWT(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/app/installations/%s/access_tokens", strings.TrimSuffix(a.APIURL, "/"), a.InstallationID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create installation token request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request installation token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read installation token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Message != "" {
+			return nil, fmt.Errorf("failed to request installation token: %s: %s", resp.Status, apiErr.Message)
+		}
+		return nil, fmt.Errorf("failed to request installation token: %s", resp.Status)
+	}
+
+	token := &installationToken{}
+	if err := json.Unmarshal(body, token); err != nil {
+		return nil, fmt.Errorf("failed to parse installation token response: %v", err)
+	}
+	if token.Token == "" {
+		return nil, fmt.Errorf("installation token response does not contain a token")
+	}
+	return token, nil
+}
+
+// signJWT returns the RS256 signed JWT authenticating as the app. It is
+// backdated to allow for clock drift and valid for less than the 10 minutes
+// GitHub accepts.
+func (a *GitHubApp) signJWT(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-60 * time.Second).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.AppID,
+	})
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.PrivateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign GitHub App JWT: %v", err)
+	}
+	return unsigned + "." + enc.EncodeToString(signature), nil
+}
+
+// parseRSAPrivateKey parses a PEM encoded PKCS#1 or PKCS#8 RSA private key
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(bytes.TrimSpace(data))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an RSA key, got %T", key)
+	}
+	return rsaKey, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newGitHubAppServer stands in for the GitHub API. It checks the JWT against
+// the public key of the app before issuing a token.
+func newGitHubAppServer(t *testing.T, key *rsa.PrivateKey) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v3/app/installations/42/access_tokens" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if !assert.Len(t, parts, 3) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message":"A JSON web token could not be decoded"}`))
+			return
+		}
+
+		// Checked from the server goroutine, so failures must not stop the test
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims map[string]interface{}
+		assert.NoError(t, json.Unmarshal(payload, &claims))
+		assert.Equal(t, "123", claims["iss"])
+		assert.Less(t, claims["iat"].(float64), float64(time.Now().Unix()))
+		assert.Greater(t, claims["exp"].(float64), float64(time.Now().Unix()))
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token":"ghs_installation","expires_at":"2030-01-01T00:00:00Z"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestRSAKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func TestConfigureGitHubApp(t *testing.T) {
+	key, keyPEM := newTestRSAKey(t)
+	server := newGitHubAppServer(t, key)
+
+	setTestEnv(t, map[string]string{
+		"DRONE_REMOTE_URL":                  "https://ghe.example.com/org/repo.git",
+		"DRONE_NETRC_MACHINE":               "",
+		"DRONE_NETRC_USERNAME":              "",
+		"DRONE_NETRC_PASSWORD":              "",
+		"PLUGIN_GITHUB_APP_ID":              "123",
+		"PLUGIN_GITHUB_APP_INSTALLATION_ID": "42",
+		"PLUGIN_GITHUB_APP_PRIVATE_KEY":     keyPEM,
+		"PLUGIN_GITHUB_APP_API_URL":         server.URL + "/api/v3",
+	})
+
+	require.NoError(t, configureGitHubApp(context.Background()))
+	assert.Equal(t, "ghe.example.com", os.Getenv("DRONE_NETRC_MACHINE"))
+	assert.Equal(t, "x-access-token", os.Getenv("DRONE_NETRC_USERNAME"))
+	assert.Equal(t, "ghs_installation", os.Getenv("DRONE_NETRC_PASSWORD"))
+	assert.Empty(t, os.Getenv("PLUGIN_GITHUB_APP_PRIVATE_KEY"))
+}
+
+func TestConfigureGitHubApp_Errors(t *testing.T) {
+	key, _ := newTestRSAKey(t)
+	server := newGitHubAppServer(t, key)
+	_, otherPEM := newTestRSAKey(t)
+
+	setTestEnv(t, map[string]string{
+		"DRONE_NETRC_PASSWORD":      "",
+		"PLUGIN_GITHUB_APP_ID":      "123",
+		"PLUGIN_GITHUB_APP_API_URL": server.URL + "/api/v3",
+	})
+	assert.EqualError(t, configureGitHubApp(context.Background()),
+		"PLUGIN_GITHUB_APP_INSTALLATION_ID is required with PLUGIN_GITHUB_APP_ID")
+
+	t.Setenv("PLUGIN_GITHUB_APP_INSTALLATION_ID", "42")
+	t.Setenv("PLUGIN_GITHUB_APP_PRIVATE_KEY", "not a key")
+	assert.ErrorContains(t, configureGitHubApp(context.Background()), "invalid GitHub App private key")
+
+	// A key that does not belong to the app is rejected by the server
+	t.Setenv("PLUGIN_GITHUB_APP_PRIVATE_KEY", otherPEM)
+	assert.EqualError(t, configureGitHubApp(context.Background()),
+		"failed to request installation token: 401 Unauthorized: A JSON web token could not be decoded")
+	assert.Empty(t, os.Getenv("DRONE_NETRC_PASSWORD"))
+}
+
+func TestGitHubAPIURL(t *testing.T) {
+	assert.Equal(t, "https://api.github.com", githubAPIURL("github.com"))
+	assert.Equal(t, "https://api.github.com", githubAPIURL(""))
+	assert.Equal(t, "https://ghe.example.com/api/v3", githubAPIURL("ghe.example.com"))
+}
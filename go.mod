@@ -5,7 +5,9 @@ go 1.25.11
 require (
 	github.com/boyter/scc/v3 v3.7.0
 	github.com/stretchr/testify v1.10.0
+	golang.org/x/crypto v0.52.0
 	golang.org/x/exp v0.0.0-20250408133849-7e4ce0ab07d0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -21,9 +23,7 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.10 // indirect
 	go.yaml.in/yaml/v2 v2.4.3 // indirect
-	golang.org/x/crypto v0.52.0 // indirect
 	golang.org/x/sync v0.20.0 // indirect
 	golang.org/x/sys v0.45.0 // indirect
 	golang.org/x/text v0.37.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// hostKeyScanTimeout bounds each connection made to scan a host key
+const hostKeyScanTimeout = 10 * time.Second
+
+// hostKeyAlgorithms are the host key algorithms scanned, one connection each,
+// since a server only presents the key of the negotiated algorithm
+var hostKeyAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512,
+}
+
+// errHostKeyScanned aborts the handshake once the host key is known
+var errHostKeyScanned = errors.New("host key scanned")
+
+// configureSSHHostKeys pins the host keys of the SSH remote when
+// PLUGIN_SSH_KNOWN_HOSTS or PLUGIN_SSH_HOST_KEY_FINGERPRINTS is set. The keys
+// the server presents are verified against the pins before the clone, so a
+// mismatch fails with the expected and presented fingerprints. The clone
+// scripts get the pinned keys as the only known hosts through
+// DRONE_SSH_KNOWN_HOSTS. Without pins the keys of a remote behind
+// PLUGIN_SSH_PROXY are scanned here, since ssh-keyscan cannot go through the
+// proxy.
+func configureSSHHostKeys(ctx context.Context) error {
+	knownHosts := strings.TrimSpace(os.Getenv("PLUGIN_SSH_KNOWN_HOSTS"))
+	fingerprints := splitList(os.Getenv("PLUGIN_SSH_HOST_KEY_FINGERPRINTS"))
+	scanOnly := knownHosts == "" && len(fingerprints) == 0
+	if os.Getenv("DRONE_SSH_KEY") == "" || scanOnly && os.Getenv("DRONE_SSH_PROXY") == "" {
+		return nil
+	}
+
+	host := os.Getenv("DRONE_NETRC_MACHINE")
+	if host == "" {
+		host = remoteHost(os.Getenv("DRONE_REMOTE_URL"))
+	}
+	port := os.Getenv("DRONE_NETRC_PORT")
+	if port == "" {
+		port = "22"
+	}
+	address := net.JoinHostPort(host, port)
+
+	keys, err := scanHostKeys(ctx, address)
+	if err != nil {
+		return fmt.Errorf("failed to scan the host keys of %s: %v", address, err)
+	}
+
+	if scanOnly {
+		lines := []string{}
+		for _, key := range keys {
+			fmt.Printf("[INFO] trusting %s host key %s of %s scanned through the SSH proxy\n", key.Type(), ssh.FingerprintSHA256(key), address)
+			lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(address)}, key))
+		}
+		os.Setenv("DRONE_SSH_KNOWN_HOSTS", strings.Join(lines, "\n"))
+		return nil
+	}
+
+	pinned, err := pinHostKeys(address, keys, knownHosts, fingerprints)
+	if err != nil {
+		return err
+	}
+	for _, key := range pinned {
+		fmt.Printf("[INFO] verified pinned %s host key %s of %s\n", key.Type(), ssh.FingerprintSHA256(key), address)
+	}
+
+	lines := []string{}
+	if knownHosts != "" {
+		lines = append(lines, knownHosts)
+	}
+	for _, key := range pinned {
+		if matchFingerprint(key, fingerprints) {
+			lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(address)}, key))
+		}
+	}
+	os.Setenv("DRONE_SSH_KNOWN_HOSTS", strings.Join(lines, "\n"))
+	return nil
+}
+
+// pinHostKeys returns the host keys presented by the server that match the
+// known hosts or one of the fingerprints. It fails when none does.
+func pinHostKeys(address string, keys []ssh.PublicKey, knownHosts string, fingerprints []string) ([]ssh.PublicKey, error) {
+	var check ssh.HostKeyCallback
+	if knownHosts != "" {
+		file, err := os.CreateTemp("", "known_hosts-*")
+		if err != nil {
+			return nil, fmt.Errorf("failed to write known hosts: %v", err)
+		}
+		defer os.Remove(file.Name())
+		_, err = file.WriteString(knownHosts + "\n")
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to write known hosts: %v", err)
+		}
+
+		if check, err = knownhosts.New(file.Name()); err != nil {
+			return nil, fmt.Errorf("invalid PLUGIN_SSH_KNOWN_HOSTS: %v", err)
+		}
+	}
+	for _, fingerprint := range fingerprints {
+		if !strings.HasPrefix(fingerprint, "SHA256:") && !strings.HasPrefix(fingerprint, "MD5:") {
+			return nil, fmt.Errorf("invalid host key fingerprint %q, expected SHA256:... or MD5:...", fingerprint)
+		}
+	}
+
+	var pinned []ssh.PublicKey
+	var presented []string
+	for _, key := range keys {
+		presented = append(presented, key.Type()+" "+ssh.FingerprintSHA256(key))
+		if check != nil && check(address, &net.TCPAddr{}, key) == nil || matchFingerprint(key, fingerprints) {
+			pinned = append(pinned, key)
+		}
+	}
+	if len(pinned) == 0 {
+		expected := append([]string{}, fingerprints...)
+		if knownHosts != "" {
+			expected = append(expected, "the keys of PLUGIN_SSH_KNOWN_HOSTS")
+		}
+		return nil, fmt.Errorf("host key verification failed for %s: expected %s, the server presented %s",
+			address, strings.Join(expected, ", "), strings.Join(presented, ", "))
+	}
+	return pinned, nil
+}
+
+// matchFingerprint reports whether the key has one of the SHA256 or MD5
+// fingerprints, in the formats printed by ssh-keygen -l
+func matchFingerprint(key ssh.PublicKey, fingerprints []string) bool {
+	sha256 := strings.TrimRight(ssh.FingerprintSHA256(key), "=")
+	md5 := ssh.FingerprintLegacyMD5(key)
+	for _, fingerprint := range fingerprints {
+		switch {
+		case strings.HasPrefix(fingerprint, "SHA256:"):
+			if strings.TrimRight(fingerprint, "=") == sha256 {
+				return true
+			}
+		case strings.HasPrefix(fingerprint, "MD5:"):
+			if strings.EqualFold(strings.TrimPrefix(fingerprint, "MD5:"), md5) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scanHostKeys returns the host keys the SSH server at address presents,
+// like ssh-keyscan
+func scanHostKeys(ctx context.Context, address string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	var lastErr error
+	for _, algorithm := range hostKeyAlgorithms {
+		key, err := scanHostKey(ctx, address, algorithm)
+		if err != nil {
+			var opErr *net.OpError
+			if errors.As(err, &opErr) && opErr.Op == "dial" {
+				return nil, err // The server is not reachable at all
+			}
+			lastErr = err
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, lastErr
+	}
+	return keys, nil
+}
+
+// scanHostKey returns the host key of the given algorithm
+func scanHostKey(ctx context.Context, address, algorithm string) (ssh.PublicKey, error) {
+	conn, err := dialSSH(ctx, address, hostKeyScanTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(hostKeyScanTimeout))
+
+	var hostKey ssh.PublicKey
+	config := &ssh.ClientConfig{
+		User:              "git",
+		HostKeyAlgorithms: []string{algorithm},
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errHostKeyScanned
+		},
+	}
+	_, _, _, err = ssh.NewClientConn(conn, address, config)
+	if hostKey == nil {
+		return nil, err
+	}
+	return hostKey, nil
+}
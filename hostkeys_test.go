@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startSSHServer serves SSH handshakes with an ed25519 and an ecdsa host key
+// and returns the address and the host keys
+func startSSHServer(t *testing.T) (string, []ssh.PublicKey) {
+	t.Helper()
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	var keys []ssh.PublicKey
+	for _, key := range []interface{}{edKey, ecKey} {
+		signer, err := ssh.NewSignerFromKey(key)
+		require.NoError(t, err)
+		config.AddHostKey(signer)
+		keys = append(keys, signer.PublicKey())
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ssh.NewServerConn(conn, config)
+			}()
+		}
+	}()
+	return listener.Addr().String(), keys
+}
+
+func TestScanHostKeys(t *testing.T) {
+	address, keys := startSSHServer(t)
+
+	scanned, err := scanHostKeys(context.Background(), address)
+	require.NoError(t, err)
+	require.Len(t, scanned, 2)
+	assert.Equal(t, keys[0].Marshal(), scanned[0].Marshal())
+	assert.Equal(t, keys[1].Marshal(), scanned[1].Marshal())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := listener.Addr().String()
+	listener.Close()
+	_, err = scanHostKeys(context.Background(), closed)
+	assert.Error(t, err)
+}
+
+func TestPinHostKeys(t *testing.T) {
+	address, keys := startSSHServer(t)
+	other, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	require.NoError(t, err)
+	line := func(key ssh.PublicKey) string {
+		return knownhosts.Line([]string{knownhosts.Normalize(address)}, key)
+	}
+
+	pinned, err := pinHostKeys(address, keys, "", []string{ssh.FingerprintSHA256(keys[1])})
+	require.NoError(t, err)
+	assert.Equal(t, []ssh.PublicKey{keys[1]}, pinned)
+
+	pinned, err = pinHostKeys(address, keys, "", []string{"MD5:" + strings.ToUpper(ssh.FingerprintLegacyMD5(keys[0]))})
+	require.NoError(t, err)
+	assert.Equal(t, []ssh.PublicKey{keys[0]}, pinned)
+
+	pinned, err = pinHostKeys(address, keys, line(keys[0]), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []ssh.PublicKey{keys[0]}, pinned)
+
+	_, err = pinHostKeys(address, keys, "", []string{ssh.FingerprintSHA256(other.PublicKey())})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "host key verification failed")
+	assert.Contains(t, err.Error(), ssh.FingerprintSHA256(other.PublicKey()))
+	assert.Contains(t, err.Error(), ssh.FingerprintSHA256(keys[0]))
+
+	_, err = pinHostKeys(address, keys, line(other.PublicKey()), nil)
+	assert.Error(t, err)
+
+	_, err = pinHostKeys(address, keys, "", []string{"d4:1d:8c"})
+	assert.Error(t, err)
+}
+
+func TestConfigureSSHHostKeys(t *testing.T) {
+	address, keys := startSSHServer(t)
+	host, port, err := net.SplitHostPort(address)
+	require.NoError(t, err)
+
+	setTestEnv(t, map[string]string{
+		"DRONE_SSH_KEY":                    "key",
+		"DRONE_NETRC_MACHINE":              host,
+		"DRONE_NETRC_PORT":                 port,
+		"PLUGIN_SSH_KNOWN_HOSTS":           "",
+		"PLUGIN_SSH_HOST_KEY_FINGERPRINTS": ssh.FingerprintSHA256(keys[0]),
+		"DRONE_SSH_KNOWN_HOSTS":            "",
+		"DRONE_SSH_PROXY":                  "",
+	})
+
+	require.NoError(t, configureSSHHostKeys(context.Background()))
+	assert.Equal(t, knownhosts.Line([]string{knownhosts.Normalize(address)}, keys[0]), os.Getenv("DRONE_SSH_KNOWN_HOSTS"))
+
+	t.Setenv("PLUGIN_SSH_HOST_KEY_FINGERPRINTS", "SHA256:bm90IHRoZSBrZXk")
+	assert.Error(t, configureSSHHostKeys(context.Background()))
+}
+
+func TestConfigureSSHHostKeys_Proxy(t *testing.T) {
+	address, keys := startSSHServer(t)
+	host, port, err := net.SplitHostPort(address)
+	require.NoError(t, err)
+	proxy, tunnels := startTestProxy(t, "socks5")
+
+	setTestEnv(t, map[string]string{
+		"DRONE_SSH_KEY":                    "key",
+		"DRONE_NETRC_MACHINE":              host,
+		"DRONE_NETRC_PORT":                 port,
+		"PLUGIN_SSH_KNOWN_HOSTS":           "",
+		"PLUGIN_SSH_HOST_KEY_FINGERPRINTS": "",
+		"DRONE_SSH_KNOWN_HOSTS":            "",
+		"DRONE_SSH_PROXY":                  proxy,
+		"NO_PROXY":                         "",
+		"no_proxy":                         "",
+	})
+
+	// Without pins the host keys are scanned through the proxy
+	require.NoError(t, configureSSHHostKeys(context.Background()))
+	assert.NotZero(t, atomic.LoadInt32(tunnels))
+	lines := strings.Split(os.Getenv("DRONE_SSH_KNOWN_HOSTS"), "\n")
+	for _, key := range keys {
+		assert.Contains(t, lines, knownhosts.Line([]string{knownhosts.Normalize(address)}, key))
+	}
+
+	// An unreachable proxy fails the clone instead of trusting any host key
+	t.Setenv("DRONE_SSH_KNOWN_HOSTS", "")
+	t.Setenv("DRONE_SSH_PROXY", "socks5://127.0.0.1:1")
+	assert.Error(t, configureSSHHostKeys(context.Background()))
+	assert.Empty(t, os.Getenv("DRONE_SSH_KNOWN_HOSTS"))
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lfsPointerVersion starts every Git LFS pointer file
+const lfsPointerVersion = "version https://git-lfs.github.com/spec/v1"
+
+// maxLFSPointerSize is the size above which a file cannot be a pointer
+const maxLFSPointerSize = 1024
+
+// LFSReport summarizes the Git LFS objects of the checked out commit
+type LFSReport struct {
+	Objects    int      `json:"objects"`
+	Bytes      int64    `json:"bytes"`
+	Downloaded int      `json:"downloaded"`
+	Skipped    int      `json:"skipped"`
+	Missing    []string `json:"missing,omitempty"`
+	Corrupt    []string `json:"corrupt,omitempty"`
+}
+
+// lfsPointer is the content of a Git LFS pointer file
+type lfsPointer struct {
+	OID  string
+	Size int64
+}
+
+// parseLFSPointer parses a Git LFS pointer file. It reports false when data
+// is not a pointer.
+func parseLFSPointer(data []byte) (lfsPointer, bool) {
+	if len(data) > maxLFSPointerSize || !bytes.HasPrefix(data, []byte(lfsPointerVersion+"\n")) {
+		return lfsPointer{}, false
+	}
+
+	var pointer lfsPointer
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "oid":
+			pointer.OID = strings.TrimPrefix(value, "sha256:")
+		case "size":
+			pointer.Size, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	if len(pointer.OID) != sha256.Size*2 {
+		return lfsPointer{}, false
+	}
+	return pointer, true
+}
+
+// verifyLFS checks the files stored in Git LFS against their pointers in the
+// index. Files still containing their pointer are missing unless excluded by
+// the LFS include and exclude patterns, downloaded files must match the OID.
+// Files outside of a sparse checkout are ignored.
+func verifyLFS(ctx context.Context, dir string) (*LFSReport, error) {
+	paths, err := lfsTrackedFiles(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	pointers, err := indexLFSPointers(ctx, dir, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := pathFilterFromEnv("PLUGIN_LFS_INCLUDE", "PLUGIN_LFS_EXCLUDE")
+	report := &LFSReport{}
+
+	for _, path := range paths {
+		pointer, ok := pointers[path]
+		if !ok {
+			continue // Committed without the LFS filter
+		}
+		report.Objects++
+		report.Bytes += pointer.Size
+
+		f, err := os.Open(filepath.Join(dir, path))
+		if os.IsNotExist(err) {
+			report.Skipped++
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %v", path, err)
+		}
+
+		hash := sha256.New()
+		head := &bytes.Buffer{}
+		size, err := io.Copy(io.MultiWriter(hash, &limitedWriter{w: head, n: maxLFSPointerSize + 1}), f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %v", path, err)
+		}
+
+		switch {
+		case size == pointer.Size && hex.EncodeToString(hash.Sum(nil)) == pointer.OID:
+			report.Downloaded++
+		case isPointer(head.Bytes()):
+			if filter != nil && !filter.Match(path) {
+				report.Skipped++
+			} else {
+				report.Missing = append(report.Missing, path)
+			}
+		default:
+			report.Corrupt = append(report.Corrupt, path)
+		}
+	}
+	return report, nil
+}
+
+func isPointer(data []byte) bool {
+	_, ok := parseLFSPointer(data)
+	return ok
+}
+
+// lfsTrackedFiles lists the files of the index with the lfs filter attribute
+func lfsTrackedFiles(ctx context.Context, dir string) ([]string, error) {
+	files, err := runGitInput(ctx, dir, nil, "ls-files", "-z")
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+
+	out, err := runGitInput(ctx, dir, bytes.NewReader(files), "check-attr", "-z", "--stdin", "filter")
+	if err != nil {
+		return nil, err
+	}
+
+	// The output consists of path, attribute and value triplets
+	fields := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	var paths []string
+	for i := 0; i+3 <= len(fields); i += 3 {
+		if fields[i+2] == "lfs" {
+			paths = append(paths, fields[i])
+		}
+	}
+	return paths, nil
+}
+
+// indexLFSPointers reads the pointers of paths from the index
+func indexLFSPointers(ctx context.Context, dir string, paths []string) (map[string]lfsPointer, error) {
+	var input bytes.Buffer
+	var requested []string
+	for _, path := range paths {
+		if strings.Contains(path, "\n") {
+			continue // Cannot be requested from git cat-file --batch
+		}
+		fmt.Fprintf(&input, ":%s\n", path)
+		requested = append(requested, path)
+	}
+
+	out, err := runGitInput(ctx, dir, &input, "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+
+	pointers := make(map[string]lfsPointer)
+	r := bufio.NewReader(bytes.NewReader(out))
+	for _, path := range requested {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("unexpected git cat-file output for %s: %v", path, err)
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			continue // missing
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected git cat-file output for %s: %q", path, header)
+		}
+		content := make([]byte, size+1) // Content is followed by a newline
+		if _, err := io.ReadFull(r, content); err != nil {
+			return nil, fmt.Errorf("unexpected git cat-file output for %s: %v", path, err)
+		}
+		if pointer, ok := parseLFSPointer(content[:size]); ok {
+			pointers[path] = pointer
+		}
+	}
+	return pointers, nil
+}
+
+// limitedWriter keeps the first n bytes written to it and discards the rest
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.n > 0 {
+		chunk := p
+		if int64(len(chunk)) > l.n {
+			chunk = chunk[:l.n]
+		}
+		n, err := l.w.Write(chunk)
+		l.n -= int64(n)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// outputs returns the report as step outputs
+func (r *LFSReport) outputs() map[string]string {
+	return map[string]string{
+		"LFS_OBJECTS":    strconv.Itoa(r.Objects),
+		"LFS_BYTES":      strconv.FormatInt(r.Bytes, 10),
+		"LFS_DOWNLOADED": strconv.Itoa(r.Downloaded),
+		"LFS_SKIPPED":    strconv.Itoa(r.Skipped),
+		"LFS_MISSING":    strconv.Itoa(len(r.Missing)),
+		"LFS_CORRUPT":    strconv.Itoa(len(r.Corrupt)),
+	}
+}
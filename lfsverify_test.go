@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lfsPointerFor returns the pointer file Git LFS stores for content
+func lfsPointerFor(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return fmt.Sprintf("%s\noid sha256:%s\nsize %d\n", lfsPointerVersion, hex.EncodeToString(sum[:]), len(content))
+}
+
+func TestParseLFSPointer(t *testing.T) {
+	pointer, ok := parseLFSPointer([]byte(lfsPointerFor("hello")))
+	require.True(t, ok)
+	assert.Equal(t, int64(5), pointer.Size)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", pointer.OID)
+
+	_, ok = parseLFSPointer([]byte("hello"))
+	assert.False(t, ok)
+	_, ok = parseLFSPointer([]byte(lfsPointerVersion + "\noid sha256:abc\nsize 3\n"))
+	assert.False(t, ok)
+}
+
+// newLFSTestRepo commits pointer files the way git-lfs does, without
+// requiring git-lfs, and returns the repository
+func newLFSTestRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := newTestRepo(t)
+	writeTestFile(t, dir, ".gitattributes", "*.bin filter=lfs diff=lfs merge=lfs -text\n")
+	for name, content := range files {
+		writeTestFile(t, dir, name, lfsPointerFor(content))
+	}
+	writeTestFile(t, dir, "raw.bin", "committed without the filter\n")
+	gitCmd(t, dir, "add", ".")
+	gitCmd(t, dir, "commit", "-q", "-m", "add lfs files")
+	return dir
+}
+
+func TestVerifyLFS(t *testing.T) {
+	dir := newLFSTestRepo(t, map[string]string{
+		"assets/ok.bin":      "downloaded content",
+		"assets/missing.bin": "never downloaded",
+		"assets/corrupt.bin": "expected content",
+		"models/skipped.bin": "excluded content",
+	})
+	// Simulate the smudge filter for some of the files
+	writeTestFile(t, dir, "assets/ok.bin", "downloaded content")
+	writeTestFile(t, dir, "assets/corrupt.bin", "truncated")
+
+	t.Setenv("PLUGIN_LFS_EXCLUDE", "models/")
+
+	report, err := verifyLFS(context.Background(), dir)
+	require.NoError(t, err)
+	assert.Equal(t, &LFSReport{
+		Objects:    4,
+		Bytes:      int64(len("downloaded content") + len("never downloaded") + len("expected content") + len("excluded content")),
+		Downloaded: 1,
+		Skipped:    1,
+		Missing:    []string{"assets/missing.bin"},
+		Corrupt:    []string{"assets/corrupt.bin"},
+	}, report)
+}
+
+func TestRunPostClone_LFSVerifyPolicy(t *testing.T) {
+	dir := newLFSTestRepo(t, map[string]string{"data.bin": "content"})
+	t.Setenv("PLUGIN_LFS_VERIFY", "true")
+
+	outputs, _ := runPostCloneIn(t, dir)
+	assert.Equal(t, "1", outputs["LFS_OBJECTS"])
+	assert.Equal(t, "1", outputs["LFS_MISSING"])
+	assert.Equal(t, "7", outputs["LFS_BYTES"])
+
+	t.Setenv("PLUGIN_LFS_VERIFY_POLICY", "fail")
+	t.Chdir(dir)
+	assert.EqualError(t, runPostClone(), "1 LFS objects are missing and 0 corrupt")
+
+	writeTestFile(t, dir, "data.bin", "content")
+	assert.NoError(t, runPostClone())
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -147,8 +148,48 @@ func runGitClone() error {
 		return err
 	}
 
+	resetCloneReport()
+
+	if err := prepareWorkspace(); err != nil {
+		return err
+	}
+
 	ctx := context.Background()
 
+	if err := configureProxy(); err != nil {
+		return err
+	}
+
+	// The GitHub App token request trusts the CA bundle too
+	if err := configureTLS(); err != nil {
+		return err
+	}
+
+	if err := configureGitHubApp(ctx); err != nil {
+		return err
+	}
+
+	if err := configureCredentialHeaders(); err != nil {
+		return err
+	}
+
+	if err := configureSSHKey(); err != nil {
+		return err
+	}
+
+	if err := configureSSHHostKeys(ctx); err != nil {
+		return err
+	}
+
+	sshAgent, err := startSSHAgent()
+	if err != nil {
+		return err
+	}
+	defer sshAgent.Stop()
+
+	// Runs once the additional repositories are cloned as well
+	defer scrubCredentials(ctx)
+
 	// current working directory (workspace)
 	workdir, err := os.Getwd()
 	if err != nil {
@@ -156,6 +197,33 @@ func runGitClone() error {
 		os.Exit(1)
 	}
 
+	cmd, err := cloneScriptCommand(ctx)
+	if err != nil {
+		return err
+	}
+	if err := runCmds([]*exec.Cmd{cmd}, scriptEnv(), workdir, os.Stdout, os.Stderr); err != nil {
+		return err
+	}
+
+	if err := checkSkip(); err != nil {
+		return err
+	}
+
+	return cloneRepositories(ctx)
+}
+
+// scriptEnv returns the environment of the clone scripts. It lets the scripts
+// call back into this binary for the steps implemented in Go.
+func scriptEnv() []string {
+	env := os.Environ()
+	if exe, err := os.Executable(); err == nil {
+		env = setEnv(env, "DRONE_GIT_BIN", exe)
+	}
+	return setEnv(env, "DRONE_GIT_TMP_DIR", globalTmpDir)
+}
+
+// cloneScriptCommand returns the command running the clone script for the current platform
+func cloneScriptCommand(ctx context.Context) (*exec.Cmd, error) {
 	switch runtime.GOOS {
 	case "windows":
 		// Find safe PowerShell executable
@@ -165,8 +233,7 @@ func runGitClone() error {
 			"$ErrorActionPreference = 'Stop'; $ProgressPreference = 'SilentlyContinue'; %s",
 			scriptPath)
 
-		cmd := exec.CommandContext(ctx, psExe, "-Command", script)
-		return runCmds([]*exec.Cmd{cmd}, os.Environ(), workdir, os.Stdout, os.Stderr)
+		return exec.CommandContext(ctx, psExe, "-Command", script), nil
 
 	case "linux", "darwin":
 		shell := "bash"
@@ -175,12 +242,34 @@ func runGitClone() error {
 		}
 
 		scriptPath := filepath.Join(globalTmpDir, "posix", "script")
-		cmd := exec.CommandContext(ctx, shell, scriptPath)
-		return runCmds([]*exec.Cmd{cmd}, os.Environ(), workdir, os.Stdout, os.Stderr)
+		return exec.CommandContext(ctx, shell, scriptPath), nil
 
 	default:
-		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+		return nil, fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+	}
+}
+
+// prepareWorkspace verifies a persisted workspace before the clone scripts reuse it
+func prepareWorkspace() error {
+	if os.Getenv("PLUGIN_ONLY_COPY_FILE_CONTENT") == "true" ||
+		os.Getenv("PLUGIN_WORKSPACE_INTEGRITY_CHECK") == "false" {
+		return nil
+	}
+
+	workspace, err := getWorkspaceDirectory()
+	if err != nil {
+		return err
+	}
+
+	report, err := checkWorkspace(workspace)
+	if err != nil {
+		return err
 	}
+
+	if err := updateCloneReport(func(r *CloneReport) { r.Workspace = report }); err != nil {
+		slog.Warn("Failed to update clone report", "error", err)
+	}
+	return nil
 }
 
 func runCmds(cmds []*exec.Cmd, env []string, workdir string,
@@ -592,11 +681,25 @@ func getWorkspaceDirectory() (string, error) {
 }
 
 func main() {
+	// Helper commands invoked by the clone scripts
+	if len(os.Args) > 1 {
+		if code, ok := runSubcommand(os.Args[1], os.Args[2:]); ok {
+			os.Exit(code)
+		}
+	}
+
 	// Ensure temp directory cleanup happens regardless of execution path
 	defer cleanupTempDir()
 
 	// Run git clone first (core functionality - can fail the step)
 	if err := runGitClone(); err != nil {
+		var skip *skipError
+		if errors.As(err, &skip) {
+			fmt.Fprintf(os.Stdout, "Skipping: %s\n", skip.reason)
+			cleanupTempDir()
+			os.Exit(skip.code) // Nothing to do - the configured skip exit code
+		}
+
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		cleanupTempDir() // Manual cleanup before exit
 		os.Exit(1)       // Core git functionality failure - should fail step
@@ -11,6 +11,17 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// TestMain lets the test binary stand in for drone-git when the clone
+// scripts call back into DRONE_GIT_BIN
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 {
+		if code, ok := runSubcommand(os.Args[1], os.Args[2:]); ok {
+			os.Exit(code)
+		}
+	}
+	os.Exit(m.Run())
+}
+
 func TestWriteScriptsToTemp(t *testing.T) {
 	// Create a temporary directory for testing
 	tmpDir, err := os.MkdirTemp("", "drone-git-test-*")
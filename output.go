@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// writeOutputs appends KEY=VALUE lines to the file named by DRONE_OUTPUT so
+// that later steps can consume them. A key with an = sign or a line break, or
+// a value with a line break, could inject other outputs and is rejected;
+// multi-line values must be encoded by the caller, like the base64 encoded
+// commit message.
+func writeOutputs(outputs map[string]string) error {
+	outputFile := os.Getenv("DRONE_OUTPUT")
+	if outputFile == "" || len(outputs) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(outputs))
+	for key, value := range outputs {
+		if key == "" || strings.ContainsAny(key, "=\r\n") {
+			return fmt.Errorf("invalid output name %q", key)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("output %s contains a line break", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	f, err := os.OpenFile(outputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open output file %s: %v", outputFile, err)
+	}
+	defer f.Close()
+
+	for _, key := range keys {
+		if _, err := fmt.Fprintf(f, "%s=%s\n", key, outputs[key]); err != nil {
+			return fmt.Errorf("failed to write output file %s: %v", outputFile, err)
+		}
+	}
+	return nil
+}
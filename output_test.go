@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteOutputs(t *testing.T) {
+	outputFile := filepath.Join(t.TempDir(), "output.env")
+	setTestEnv(t, map[string]string{"DRONE_OUTPUT": outputFile})
+
+	require.NoError(t, writeOutputs(map[string]string{"B": "b=c", "A": "a"}))
+	data, err := os.ReadFile(outputFile)
+	require.NoError(t, err)
+	assert.Equal(t, "A=a\nB=b=c\n", string(data))
+
+	// nothing is written when one of the outputs could inject another
+	for _, outputs := range []map[string]string{
+		{"OK": "ok", "FILES": "a.txt\nSKIP=true"},
+		{"OK": "ok", "FILES": "a.txt\r"},
+		{"OK": "ok", "SKIP=true\nFILES": "a.txt"},
+		{"": "empty"},
+	} {
+		assert.Error(t, writeOutputs(outputs))
+	}
+	data, err = os.ReadFile(outputFile)
+	require.NoError(t, err)
+	assert.Equal(t, "A=a\nB=b=c\n", string(data))
+}
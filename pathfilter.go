@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// PathFilter decides whether the changes of a build are relevant based on
+// include and exclude globs
+type PathFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// newPathFilter reads the globs from PLUGIN_PATH_FILTER_INCLUDE and
+// PLUGIN_PATH_FILTER_EXCLUDE. It returns nil when no filter is configured.
+func newPathFilter() *PathFilter {
+	return pathFilterFromEnv("PLUGIN_PATH_FILTER_INCLUDE", "PLUGIN_PATH_FILTER_EXCLUDE")
+}
+
+// pathFilterFromEnv builds a filter from the comma or newline separated globs
+// of the given variables. It returns nil when both are empty.
+func pathFilterFromEnv(includeKey, excludeKey string) *PathFilter {
+	include := splitList(os.Getenv(includeKey))
+	exclude := splitList(os.Getenv(excludeKey))
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil
+	}
+
+	filter := &PathFilter{}
+	for _, glob := range include {
+		filter.include = append(filter.include, globToRegexp(glob))
+	}
+	for _, glob := range exclude {
+		filter.exclude = append(filter.exclude, globToRegexp(glob))
+	}
+	return filter
+}
+
+// Match reports whether path is included and not excluded by the filter
+func (f *PathFilter) Match(path string) bool {
+	for _, re := range f.exclude {
+		if re.MatchString(path) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns the paths of files matched by the filter. Renamed files
+// match on either their old or new path.
+func (f *PathFilter) Matches(files []ChangedFile) []string {
+	var matched []string
+	for _, file := range files {
+		if f.Match(file.Path) || (file.OldPath != "" && f.Match(file.OldPath)) {
+			matched = append(matched, file.Path)
+		}
+	}
+	return matched
+}
+
+// globToRegexp compiles a glob matched against repository relative paths.
+// '*' and '?' do not cross directory boundaries while '**' does. As in
+// .gitignore, a glob without a slash matches at any depth and a glob that
+// matches a directory matches everything below it.
+func globToRegexp(glob string) *regexp.Regexp {
+	glob = strings.TrimPrefix(glob, "./")
+	if strings.HasSuffix(glob, "/") {
+		glob += "**"
+	}
+	if !strings.Contains(glob, "/") {
+		glob = "**/" + glob
+	}
+	glob = strings.TrimPrefix(glob, "/")
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			sb.WriteString("(?:/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	// A glob matching a directory matches everything below it
+	if !strings.HasSuffix(glob, "**") {
+		sb.WriteString("(?:/.*)?")
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+// splitList splits a comma or newline separated setting, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
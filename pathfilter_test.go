@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		path  string
+		match bool
+	}{
+		{"*.md", "README.md", true},
+		{"*.md", "docs/guide/index.md", true},
+		{"*.md", "README.mdx", false},
+		{"services/api/**", "services/api/main.go", true},
+		{"services/api/**", "services/api/internal/db/db.go", true},
+		{"services/api/**", "services/apis/main.go", false},
+		{"services/api/", "services/api/main.go", true},
+		{"services/api", "services/api/main.go", true},
+		{"services/*/main.go", "services/web/main.go", true},
+		{"services/*/main.go", "services/web/cmd/main.go", false},
+		{"services/**/main.go", "services/web/cmd/main.go", true},
+		{"services/**/main.go", "services/main.go", true},
+		{"/go.mod", "go.mod", true},
+		{"/go.mod", "tools/go.mod", false},
+		{"docs/?.txt", "docs/a.txt", true},
+		{"docs/?.txt", "docs/ab.txt", false},
+		{"lib/(legacy)/*", "lib/(legacy)/a.c", true},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.match, globToRegexp(tt.glob).MatchString(tt.path), "glob %q path %q", tt.glob, tt.path)
+	}
+}
+
+func TestPathFilter(t *testing.T) {
+	os.Setenv("PLUGIN_PATH_FILTER_INCLUDE", "services/api/**,libs/**")
+	os.Setenv("PLUGIN_PATH_FILTER_EXCLUDE", "*.md")
+	defer func() {
+		os.Unsetenv("PLUGIN_PATH_FILTER_INCLUDE")
+		os.Unsetenv("PLUGIN_PATH_FILTER_EXCLUDE")
+	}()
+
+	filter := newPathFilter()
+	require.NotNil(t, filter)
+
+	matched := filter.Matches([]ChangedFile{
+		{Path: "services/api/main.go", Status: "modified"},
+		{Path: "services/api/README.md", Status: "modified"},
+		{Path: "services/web/index.js", Status: "added"},
+		{Path: "shared/util.go", OldPath: "libs/util.go", Status: "renamed"},
+	})
+	assert.Equal(t, []string{"services/api/main.go", "shared/util.go"}, matched)
+
+	os.Unsetenv("PLUGIN_PATH_FILTER_INCLUDE")
+	os.Unsetenv("PLUGIN_PATH_FILTER_EXCLUDE")
+	assert.Nil(t, newPathFilter())
+}
+
+func TestSplitList(t *testing.T) {
+	assert.Equal(t, []string{"a", "b/c", "d"}, splitList("a, b/c\n\nd,"))
+	assert.Empty(t, splitList(""))
+}
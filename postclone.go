@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// skipFileName is written to DRONE_GIT_TMP_DIR when the post-clone phase
+// decides that the build has nothing to do
+const skipFileName = "skip"
+
+// postClone holds the state shared by the phases inspecting the checked out
+// repository
+type postClone struct {
+	ctx     context.Context
+	dir     string
+	outputs map[string]string
+	skip    []string
+
+	changesLoaded bool
+	changeRange   *ChangeRange
+	changedFiles  []ChangedFile
+	changesErr    error
+}
+
+// runPostClone runs the phases that inspect the checked out repository. The
+// clone scripts invoke it as `drone-git post-clone` once the checkout is
+// complete, so it shares their environment including the credentials needed
+// to fetch more history.
+func runPostClone() error {
+	if os.Getenv("DRONE_GIT_ADDITIONAL_REPOSITORY") == "true" {
+		return nil // Additional repositories are not inspected
+	}
+
+	workdir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("cannot get working directory: %v", err)
+	}
+
+	p := &postClone{
+		ctx:     context.Background(),
+		dir:     workdir,
+		outputs: make(map[string]string),
+	}
+
+	if err := p.exportCommit(); err != nil {
+		return err
+	}
+
+	if os.Getenv("PLUGIN_LFS_VERIFY") == "true" {
+		if err := p.verifyLFS(); err != nil {
+			return err
+		}
+	}
+
+	if changedFilesEnabled() {
+		if err := p.exportChangedFiles(); err != nil {
+			return err
+		}
+	}
+
+	if os.Getenv("PLUGIN_SEMVER") == "true" {
+		result, err := computeSemver(p.ctx, p.dir)
+		if err != nil {
+			return fmt.Errorf("cannot compute version: %v", err)
+		}
+		fmt.Printf("[INFO] version %s, next %s (%s)\n", result.Current, result.Next, result.Bump)
+		for key, value := range result.outputs() {
+			p.outputs[key] = value
+		}
+	}
+
+	if changelogEnabled() {
+		if err := p.exportChangelog(); err != nil {
+			return err
+		}
+	}
+
+	skippable := false
+	if filter := newPathFilter(); filter != nil {
+		skippable = true
+		p.applyPathFilter(filter)
+	}
+	if skipCIEnabled() {
+		skippable = true
+		if err := p.applySkipCI(); err != nil {
+			return err
+		}
+	}
+
+	if skippable {
+		p.outputs["SKIP"] = strconv.FormatBool(len(p.skip) > 0)
+		p.outputs["SKIP_REASON"] = strings.Join(p.skip, "; ")
+	}
+	if err := writeOutputs(p.outputs); err != nil {
+		return err
+	}
+
+	if len(p.skip) > 0 {
+		return requestSkip(strings.Join(p.skip, "; "))
+	}
+	return nil
+}
+
+// exportCommit records the metadata of the checked out commit in the clone
+// report and, when PLUGIN_COMMIT_METADATA is enabled, in the step outputs
+func (p *postClone) exportCommit() error {
+	enabled := os.Getenv("PLUGIN_COMMIT_METADATA") == "true"
+	if !enabled && os.Getenv("PLUGIN_CLONE_REPORT_FILE") == "" {
+		return nil
+	}
+
+	commit, err := readCommit(p.ctx, p.dir, "HEAD")
+	if err != nil {
+		return fmt.Errorf("cannot read commit metadata: %v", err)
+	}
+
+	if err := updateCloneReport(func(r *CloneReport) { r.Commit = commit }); err != nil {
+		slog.Warn("Failed to update clone report", "error", err)
+	}
+	if enabled {
+		for key, value := range commit.outputs() {
+			p.outputs[key] = value
+		}
+	}
+	return nil
+}
+
+// exportChangelog writes the release notes of tag builds
+func (p *postClone) exportChangelog() error {
+	if cloneType() != "tag" {
+		slog.Info("Changelog not generated, the build is not a tag build", "event", cloneType())
+		return nil
+	}
+
+	changelog, err := generateChangelog(p.ctx, p.dir)
+	if err != nil {
+		return fmt.Errorf("cannot generate changelog: %v", err)
+	}
+	fmt.Printf("[INFO] changelog of %s lists %d commits since %s\n",
+		changelog.Tag, len(changelog.Commits), changelog.PreviousTag)
+
+	p.outputs["CHANGELOG_PREVIOUS_TAG"] = changelog.PreviousTag
+	return writeChangelog(changelog)
+}
+
+// verifyLFS reports the state of the Git LFS objects of the checkout. With
+// PLUGIN_LFS_VERIFY_POLICY=fail missing or corrupt objects fail the clone.
+func (p *postClone) verifyLFS() error {
+	policy := os.Getenv("PLUGIN_LFS_VERIFY_POLICY")
+	if policy != "" && policy != "warn" && policy != "fail" {
+		return fmt.Errorf("invalid PLUGIN_LFS_VERIFY_POLICY %q, expected warn or fail", policy)
+	}
+
+	report, err := verifyLFS(p.ctx, p.dir)
+	if err != nil {
+		return fmt.Errorf("cannot verify LFS objects: %v", err)
+	}
+	fmt.Printf("[INFO] %d LFS objects (%d bytes): %d downloaded, %d skipped, %d missing, %d corrupt\n",
+		report.Objects, report.Bytes, report.Downloaded, report.Skipped, len(report.Missing), len(report.Corrupt))
+	for _, path := range report.Missing {
+		fmt.Printf("  missing: %s\n", path)
+	}
+	for _, path := range report.Corrupt {
+		fmt.Printf("  corrupt: %s\n", path)
+	}
+
+	if err := updateCloneReport(func(r *CloneReport) { r.LFS = report }); err != nil {
+		slog.Warn("Failed to update clone report", "error", err)
+	}
+	for key, value := range report.outputs() {
+		p.outputs[key] = value
+	}
+
+	if policy == "fail" && len(report.Missing)+len(report.Corrupt) > 0 {
+		// Publish the outputs before failing so later steps can report them
+		if err := writeOutputs(p.outputs); err != nil {
+			return err
+		}
+		return fmt.Errorf("%d LFS objects are missing and %d corrupt", len(report.Missing), len(report.Corrupt))
+	}
+	return nil
+}
+
+// changes computes the change range and changed files of the build once
+func (p *postClone) changes() (*ChangeRange, []ChangedFile, error) {
+	if !p.changesLoaded {
+		p.changesLoaded = true
+		p.changeRange, p.changesErr = resolveChangeRange(p.ctx, p.dir)
+		if p.changesErr == nil && p.changeRange != nil {
+			p.changedFiles, p.changesErr = diffChangedFiles(p.ctx, p.dir, p.changeRange)
+		}
+	}
+	return p.changeRange, p.changedFiles, p.changesErr
+}
+
+// applyPathFilter requests a skip when none of the changed files match the
+// filter. When the changes cannot be determined the build is never skipped.
+func (p *postClone) applyPathFilter(filter *PathFilter) {
+	changeRange, files, err := p.changes()
+	if err != nil {
+		slog.Warn("Cannot determine changed files, path filter not applied", "error", err)
+		return
+	}
+	if changeRange == nil {
+		slog.Info("Path filter not applied, the build event has no changes to compare", "event", cloneType())
+		return
+	}
+
+	matched := filter.Matches(files)
+	fmt.Printf("[INFO] path filter matched %d of %d changed files between %s and %s\n",
+		len(matched), len(files), changeRange.Base, changeRange.Head)
+	for _, path := range matched {
+		fmt.Printf("  %s\n", path)
+	}
+
+	if len(matched) == 0 {
+		p.skip = append(p.skip, "no changed files match the path filter")
+	}
+}
+
+// requestSkip records the skip decision for the drone-git process that runs
+// the clone scripts
+func requestSkip(reason string) error {
+	fmt.Printf("[INFO] nothing to do: %s\n", reason)
+
+	tmpDir := os.Getenv("DRONE_GIT_TMP_DIR")
+	if tmpDir == "" {
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, skipFileName), []byte(reason), 0644); err != nil {
+		return fmt.Errorf("failed to record skip decision: %v", err)
+	}
+	return nil
+}
+
+// skipError is returned by the clone when the post-clone phase decided that
+// the build has nothing to do and PLUGIN_SKIP_EXIT_CODE is set
+type skipError struct {
+	code   int
+	reason string
+}
+
+func (e *skipError) Error() string {
+	return "nothing to do: " + e.reason
+}
+
+// checkSkip turns a skip decision of the post-clone phase into a skipError
+func checkSkip() error {
+	value := os.Getenv("PLUGIN_SKIP_EXIT_CODE")
+	if value == "" || globalTmpDir == "" {
+		return nil
+	}
+
+	reason, err := os.ReadFile(filepath.Join(globalTmpDir, skipFileName))
+	if err != nil {
+		return nil // No skip requested
+	}
+
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid PLUGIN_SKIP_EXIT_CODE %q: %v", value, err)
+	}
+	return &skipError{code: code, reason: string(reason)}
+}
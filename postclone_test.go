@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runPostCloneIn runs the post-clone phase in dir and returns the outputs it
+// wrote and the skip reason it recorded
+func runPostCloneIn(t *testing.T, dir string) (map[string]string, string) {
+	t.Helper()
+
+	tmpDir := t.TempDir()
+	outputFile := filepath.Join(tmpDir, "output")
+	t.Setenv("DRONE_OUTPUT", outputFile)
+	t.Setenv("DRONE_GIT_TMP_DIR", tmpDir)
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	require.NoError(t, runPostClone())
+
+	var outputs map[string]string
+	if _, err := os.Stat(outputFile); err == nil {
+		outputs = readOutputs(t, outputFile)
+	}
+	reason, _ := os.ReadFile(filepath.Join(tmpDir, skipFileName))
+	return outputs, string(reason)
+}
+
+func TestRunPostClone_PathFilter(t *testing.T) {
+	dir := newTestRepo(t)
+	before := gitCmd(t, dir, "rev-parse", "HEAD")
+	commitTestFile(t, dir, "docs/guide.md", "guide\n", "docs")
+
+	setTestEnv(t, map[string]string{
+		"DRONE_BUILD_EVENT":   "push",
+		"DRONE_COMMIT_BEFORE": before,
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		t.Setenv("PLUGIN_PATH_FILTER_INCLUDE", "src/**,*.go")
+
+		outputs, reason := runPostCloneIn(t, dir)
+		assert.Equal(t, "true", outputs["SKIP"])
+		assert.Equal(t, "no changed files match the path filter", outputs["SKIP_REASON"])
+		assert.Equal(t, "no changed files match the path filter", reason)
+	})
+
+	t.Run("match", func(t *testing.T) {
+		t.Setenv("PLUGIN_PATH_FILTER_INCLUDE", "docs/")
+
+		outputs, reason := runPostCloneIn(t, dir)
+		assert.Equal(t, "false", outputs["SKIP"])
+		assert.Empty(t, reason)
+	})
+
+	t.Run("exclude", func(t *testing.T) {
+		t.Setenv("PLUGIN_PATH_FILTER_EXCLUDE", "*.md")
+
+		outputs, _ := runPostCloneIn(t, dir)
+		assert.Equal(t, "true", outputs["SKIP"])
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		outputs, reason := runPostCloneIn(t, dir)
+		assert.Empty(t, outputs)
+		assert.Empty(t, reason)
+	})
+}
+
+func TestCheckSkip(t *testing.T) {
+	tmpDir := t.TempDir()
+	old := globalTmpDir
+	globalTmpDir = tmpDir
+	defer func() { globalTmpDir = old }()
+
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, skipFileName), []byte("no changes"), 0644))
+
+	// Without an exit code the clone succeeds and only the outputs are written
+	assert.NoError(t, checkSkip())
+
+	t.Setenv("PLUGIN_SKIP_EXIT_CODE", "78")
+	err := checkSkip()
+	var skip *skipError
+	require.True(t, errors.As(err, &skip))
+	assert.Equal(t, 78, skip.code)
+	assert.Equal(t, "no changes", skip.reason)
+
+	t.Setenv("PLUGIN_SKIP_EXIT_CODE", "abc")
+	assert.Error(t, checkSkip())
+
+	require.NoError(t, os.Remove(filepath.Join(tmpDir, skipFileName)))
+	assert.NoError(t, checkSkip())
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyDialTimeout bounds the connection to the proxy and its handshake
+const proxyDialTimeout = 30 * time.Second
+
+// configureProxy passes the proxy settings to every git process through
+// GIT_CONFIG_COUNT, so that they apply to submodules and LFS too and are not
+// persisted in the git config:
+//
+//   - HARNESS_HTTPS_PROXY, with HARNESS_GIT_PROXY=true, becomes http.proxy
+//   - the url=proxy rules of PLUGIN_PROXIES become http.<url>.proxy, an empty
+//     proxy connects directly
+//   - the hosts of PLUGIN_NO_PROXY are added to NO_PROXY, which git, git LFS
+//     and the ssh proxy honor
+//   - PLUGIN_SSH_PROXY, an http, https or socks5 proxy URL or true for the
+//     HTTPS proxy, becomes DRONE_SSH_PROXY, which the scripts pass to ssh as
+//     a ProxyCommand running drone-git ssh-proxy
+//
+// Proxy credentials are masked in the log.
+func configureProxy() error {
+	var defaultProxy string
+	if os.Getenv("HARNESS_GIT_PROXY") == "true" {
+		defaultProxy = os.Getenv("HARNESS_HTTPS_PROXY")
+	}
+
+	if noProxy := splitList(os.Getenv("PLUGIN_NO_PROXY")); len(noProxy) > 0 {
+		hosts := append(noProxyList(), noProxy...)
+		fmt.Printf("[INFO] connecting directly to %s\n", strings.Join(noProxy, ", "))
+		os.Setenv("NO_PROXY", strings.Join(hosts, ","))
+		os.Setenv("no_proxy", strings.Join(hosts, ","))
+	}
+
+	if defaultProxy != "" {
+		if _, err := parseProxyURL(defaultProxy); err != nil {
+			return fmt.Errorf("invalid HARNESS_HTTPS_PROXY %s: %v", maskURL(defaultProxy), err)
+		}
+		fmt.Printf("[INFO] using proxy %s for HTTP(S) remotes\n", maskURL(defaultProxy))
+		addGitConfigEnv("http.proxy", defaultProxy)
+	}
+
+	for _, rule := range splitList(os.Getenv("PLUGIN_PROXIES")) {
+		prefix, proxy, ok := strings.Cut(rule, "=")
+		if !ok || prefix == "" {
+			return fmt.Errorf("invalid proxy rule %s, expected url=proxy", maskURL(rule))
+		}
+		if proxy == "" {
+			fmt.Printf("[INFO] connecting directly to %s\n", prefix)
+		} else if _, err := parseProxyURL(proxy); err != nil {
+			return fmt.Errorf("invalid proxy %s for %s: %v", maskURL(proxy), prefix, err)
+		} else {
+			fmt.Printf("[INFO] using proxy %s for %s\n", maskURL(proxy), prefix)
+		}
+		addGitConfigEnv("http."+prefix+".proxy", proxy)
+	}
+
+	sshProxy := os.Getenv("PLUGIN_SSH_PROXY")
+	if sshProxy == "true" {
+		if defaultProxy == "" {
+			return fmt.Errorf("PLUGIN_SSH_PROXY=true requires HARNESS_GIT_PROXY and HARNESS_HTTPS_PROXY")
+		}
+		sshProxy = defaultProxy
+	}
+	if sshProxy != "" && sshProxy != "false" {
+		if _, err := parseProxyURL(sshProxy); err != nil {
+			return fmt.Errorf("invalid PLUGIN_SSH_PROXY %s: %v", maskURL(sshProxy), err)
+		}
+		fmt.Printf("[INFO] using proxy %s for SSH remotes\n", maskURL(sshProxy))
+		os.Setenv("DRONE_SSH_PROXY", sshProxy)
+	}
+	return nil
+}
+
+// parseProxyURL parses an http, https or socks5 proxy URL. A proxy without a
+// scheme is an http proxy, as for git.
+func parseProxyURL(value string) (*url.URL, error) {
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse proxy URL")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %s", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("the proxy URL has no host")
+	}
+	return u, nil
+}
+
+// noProxyList returns the hosts of the NO_PROXY environment variable
+func noProxyList() []string {
+	value := os.Getenv("NO_PROXY")
+	if value == "" {
+		value = os.Getenv("no_proxy")
+	}
+	return splitList(value)
+}
+
+// noProxyMatch reports whether address is excluded from proxying by one of
+// the NO_PROXY style entries: * for every host, a host name that also
+// matches its subdomains with or without a leading dot or *., an IP address
+// or CIDR range, each optionally with a port.
+func noProxyMatch(address string, entries []string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost := entry
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entryHost = h
+		}
+		entryHost = strings.TrimPrefix(strings.TrimPrefix(entryHost, "*"), ".")
+		if entryIP := net.ParseIP(strings.Trim(entryHost, "[]")); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if entryHost != "" && (host == entryHost || strings.HasSuffix(host, "."+entryHost)) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpProxy returns the proxy of an HTTP request made by drone-git itself,
+// following the settings configureProxy passes to git: NO_PROXY hosts are
+// connected to directly, the longest matching PLUGIN_PROXIES rule comes
+// before HARNESS_HTTPS_PROXY, and the standard proxy variables apply
+// otherwise
+func httpProxy(req *http.Request) (*url.URL, error) {
+	port := req.URL.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[req.URL.Scheme]
+	}
+	if noProxyMatch(net.JoinHostPort(req.URL.Hostname(), port), noProxyList()) {
+		return nil, nil
+	}
+
+	var match, proxy string
+	for _, rule := range splitList(os.Getenv("PLUGIN_PROXIES")) {
+		prefix, value, _ := strings.Cut(rule, "=")
+		if len(prefix) > len(match) && matchURLPrefix(req.URL, prefix) {
+			match, proxy = prefix, value
+		}
+	}
+	if match == "" {
+		if os.Getenv("HARNESS_GIT_PROXY") != "true" || os.Getenv("HARNESS_HTTPS_PROXY") == "" {
+			return http.ProxyFromEnvironment(req)
+		}
+		proxy = os.Getenv("HARNESS_HTTPS_PROXY")
+	}
+	if proxy == "" {
+		return nil, nil
+	}
+	return parseProxyURL(proxy)
+}
+
+// matchURLPrefix reports whether u is below the URL prefix the way git
+// matches http.<url>.* settings: same scheme and host, and a path prefix
+// ending at a path segment
+func matchURLPrefix(u *url.URL, prefix string) bool {
+	p, err := url.Parse(prefix)
+	if err != nil || p.Scheme != u.Scheme || !strings.EqualFold(p.Host, u.Host) {
+		return false
+	}
+	path := strings.Trim(p.Path, "/")
+	return path == "" || strings.Trim(u.Path, "/") == path || strings.HasPrefix(strings.TrimPrefix(u.Path, "/"), path+"/")
+}
+
+// dialSSH connects to the SSH server at address, through DRONE_SSH_PROXY
+// unless the host is excluded by NO_PROXY
+func dialSSH(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	proxy := os.Getenv("DRONE_SSH_PROXY")
+	if proxy == "" || noProxyMatch(address, noProxyList()) {
+		dialer := &net.Dialer{Timeout: timeout}
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	proxyURL, err := parseProxyURL(proxy)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	conn, err := dialProxy(ctx, proxyURL, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	return conn, nil
+}
+
+// dialProxy opens a connection to address through the proxy, with an HTTP
+// CONNECT request or a SOCKS5 handshake
+func dialProxy(ctx context.Context, proxyURL *url.URL, address string) (net.Conn, error) {
+	defaultPort := map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}
+	proxyAddress := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddress = net.JoinHostPort(proxyURL.Hostname(), defaultPort[proxyURL.Scheme])
+	}
+
+	dialer := &net.Dialer{Timeout: proxyDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %v", maskURL(proxyURL.String()), err)
+	}
+	conn.SetDeadline(time.Now().Add(proxyDialTimeout))
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to connect to proxy %s: %v", maskURL(proxyURL.String()), err)
+		}
+		conn = tlsConn
+	}
+
+	tunnel := conn
+	if strings.HasPrefix(proxyURL.Scheme, "socks5") {
+		err = socks5Connect(conn, proxyURL.User, address)
+	} else {
+		tunnel, err = httpConnect(conn, proxyURL.User, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", maskURL(proxyURL.String()), err)
+	}
+	tunnel.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// bufferedConn reads from the buffer that read the CONNECT response first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return nil
+}
+
+// httpConnect opens a tunnel to address with an HTTP CONNECT request
+func httpConnect(conn net.Conn, user *url.Userinfo, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to send CONNECT request: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CONNECT response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s failed: %s", address, resp.Status)
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// socks5Errors are the messages of the SOCKS5 reply codes
+var socks5Errors = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5Connect opens a tunnel to address with a SOCKS5 handshake (RFC 1928)
+// and username/password authentication (RFC 1929). Host names are resolved
+// by the proxy.
+func socks5Connect(conn net.Conn, user *url.Userinfo, address string) error {
+	host, portValue, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portValue, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", portValue)
+	}
+
+	methods := []byte{0x00}
+	if user != nil {
+		methods = []byte{0x00, 0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return fmt.Errorf("failed to send SOCKS5 greeting: %v", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 greeting: %v", err)
+	}
+	switch {
+	case reply[0] != 0x05:
+		return fmt.Errorf("not a SOCKS5 proxy")
+	case reply[1] == 0x02 && user != nil:
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return fmt.Errorf("SOCKS5 credentials are too long")
+		}
+		auth := []byte{0x01, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return fmt.Errorf("failed to send SOCKS5 credentials: %v", err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("failed to read SOCKS5 authentication: %v", err)
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("SOCKS5 authentication failed")
+		}
+	case reply[1] != 0x00:
+		return fmt.Errorf("no acceptable SOCKS5 authentication method")
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %s is too long", host)
+		}
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(append(request, 0x01), ip4...)
+	} else {
+		request = append(append(request, 0x04), ip.To16()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("failed to send SOCKS5 request: %v", err)
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 reply: %v", err)
+	}
+	if header[1] != 0x00 {
+		message, ok := socks5Errors[header[1]]
+		if !ok {
+			message = fmt.Sprintf("error %d", header[1])
+		}
+		return fmt.Errorf("SOCKS5 connect to %s failed: %s", address, message)
+	}
+
+	// Skip the bound address and port
+	var length int
+	switch header[3] {
+	case 0x01:
+		length = net.IPv4len
+	case 0x04:
+		length = net.IPv6len
+	case 0x03:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return fmt.Errorf("failed to read SOCKS5 reply: %v", err)
+		}
+		length = int(size[0])
+	default:
+		return fmt.Errorf("invalid SOCKS5 reply")
+	}
+	if _, err := io.ReadFull(conn, make([]byte, length+2)); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 reply: %v", err)
+	}
+	return nil
+}
+
+// runSSHProxy is the ProxyCommand of ssh. It connects to the host and port
+// of its arguments through DRONE_SSH_PROXY and relays stdin and stdout.
+func runSSHProxy(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: ssh-proxy <host> <port>")
+	}
+	conn, err := dialSSH(context.Background(), net.JoinHostPort(args[0], args[1]), proxyDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, stdin)
+		if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+			closer.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(stdout, conn)
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/exp/slog"
+)
+
+// CloneReport summarizes what happened during the clone step. It is written to
+// PLUGIN_CLONE_REPORT_FILE and may be updated by several phases of the clone.
+type CloneReport struct {
+	Repository    string             `json:"repository,omitempty"`
+	PluginVersion string             `json:"plugin_version"`
+	Workspace     *WorkspaceReport   `json:"workspace,omitempty"`
+	Commit        *CommitMetadata    `json:"commit,omitempty"`
+	LFS           *LFSReport         `json:"lfs,omitempty"`
+	Repositories  []RepositoryReport `json:"repositories,omitempty"`
+	Credentials   *CredentialsReport `json:"credentials,omitempty"`
+}
+
+// updateCloneReport loads the clone report, applies fn and writes it back.
+// It is a no-op when PLUGIN_CLONE_REPORT_FILE is not set.
+func updateCloneReport(fn func(report *CloneReport)) error {
+	reportFile := os.Getenv("PLUGIN_CLONE_REPORT_FILE")
+	if reportFile == "" {
+		return nil
+	}
+
+	report := &CloneReport{}
+	if data, err := os.ReadFile(reportFile); err == nil {
+		if err := json.Unmarshal(data, report); err != nil {
+			return fmt.Errorf("failed to parse clone report %s: %v", reportFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read clone report %s: %v", reportFile, err)
+	}
+
+	fn(report)
+	report.Repository = getRepositoryURL()
+	report.PluginVersion = getPluginVersion()
+
+	jsonData, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal clone report: %v", err)
+	}
+
+	if err := os.WriteFile(reportFile, jsonData, 0644); err != nil {
+		return fmt.Errorf("failed to write clone report %s: %v", reportFile, err)
+	}
+	return nil
+}
+
+// resetCloneReport removes a clone report left behind by a previous build
+func resetCloneReport() {
+	reportFile := os.Getenv("PLUGIN_CLONE_REPORT_FILE")
+	if reportFile == "" {
+		return
+	}
+	if err := os.Remove(reportFile); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove previous clone report", "file", reportFile, "error", err)
+	}
+}
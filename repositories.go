@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultRepositoriesConcurrency is the number of additional repositories
+// cloned at the same time when PLUGIN_REPOSITORIES_CONCURRENCY is not set
+const defaultRepositoriesConcurrency = 4
+
+// repositoryRetryDelay is the delay before the first retry of a failed
+// repository clone, doubled on every attempt like the submodule retries
+var repositoryRetryDelay = 2 * time.Second
+
+var commitSHA = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+// errNotABranch fails the clone of a bare ref the remote has no branch for,
+// such as a tag given without refs/tags/. It is not retried.
+var errNotABranch = errors.New("is not a branch")
+
+// Repository is an additional repository listed in the repositories manifest
+type Repository struct {
+	URL         string `json:"url" yaml:"url"`
+	Ref         string `json:"ref" yaml:"ref"`
+	Path        string `json:"path" yaml:"path"`
+	Depth       int    `json:"depth,omitempty" yaml:"depth"`
+	Credentials string `json:"credentials,omitempty" yaml:"credentials"`
+}
+
+// RepositoryReport records the outcome of cloning an additional repository
+type RepositoryReport struct {
+	URL    string `json:"url"`
+	Ref    string `json:"ref"`
+	Path   string `json:"path"`
+	Commit string `json:"commit,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// repositoryCloneUnsetEnv lists the variables describing the primary build
+// that must not leak into the clone of an additional repository
+var repositoryCloneUnsetEnv = []string{
+	"DRONE_BUILD_EVENT",
+	"DRONE_COMMIT_REF",
+	"DRONE_COMMIT_SHA",
+	"DRONE_COMMIT_BRANCH",
+	"DRONE_COMMIT_BEFORE",
+	"DRONE_COMMIT_AFTER",
+	"DRONE_SOURCE_BRANCH",
+	"DRONE_TARGET_BRANCH",
+	"DRONE_TAG",
+	"DRONE_PR_MERGE_STRATEGY_BRANCH",
+	"DRONE_NETRC_SPARSE_CHECKOUT",
+	"DRONE_NETRC_PRE_FETCH",
+	"DRONE_OUTPUT",
+	"PLUGIN_PR_CLONE_STRATEGY",
+	"PLUGIN_DEPTH",
+	"PLUGIN_ONLY_COPY_FILE_CONTENT",
+	"PLUGIN_OUTPUT_FILE_PATHS_CONTENT",
+	"PLUGIN_CLONE_REPORT_FILE",
+	"PLUGIN_BUILD_TOOL_FILE",
+	"PLUGIN_WORKTREE_PATH",
+	"PLUGIN_WORKTREE_REF",
+}
+
+// loadRepositories reads the repositories manifest from PLUGIN_REPOSITORIES
+// (inline JSON or YAML) or from the file named by PLUGIN_REPOSITORIES_FILE
+func loadRepositories() ([]Repository, error) {
+	data := []byte(os.Getenv("PLUGIN_REPOSITORIES"))
+	if manifest := os.Getenv("PLUGIN_REPOSITORIES_FILE"); manifest != "" {
+		var err error
+		if data, err = os.ReadFile(manifest); err != nil {
+			return nil, fmt.Errorf("failed to read repositories manifest %s: %v", manifest, err)
+		}
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	var repositories []Repository
+	if err := yaml.Unmarshal(data, &repositories); err != nil {
+		return nil, fmt.Errorf("failed to parse repositories manifest: %v", err)
+	}
+
+	paths := make(map[string]bool)
+	for i, repo := range repositories {
+		switch {
+		case repo.URL == "":
+			return nil, fmt.Errorf("repository %d: url is required", i)
+		case repo.Ref == "":
+			return nil, fmt.Errorf("repository %s: ref is required", repo.URL)
+		case repo.Path == "" || filepath.IsAbs(repo.Path):
+			return nil, fmt.Errorf("repository %s: path must be a relative directory", repo.URL)
+		case repo.Depth < 0:
+			return nil, fmt.Errorf("repository %s: depth must not be negative", repo.URL)
+		}
+		clean := filepath.Clean(repo.Path)
+		if slashed := filepath.ToSlash(clean); slashed == ".." || strings.HasPrefix(slashed, "../") {
+			return nil, fmt.Errorf("repository %s: path %s is outside the workspace", repo.URL, repo.Path)
+		}
+		if clean == "." || paths[clean] {
+			return nil, fmt.Errorf("repository %s: path %s is already in use", repo.URL, repo.Path)
+		}
+		paths[clean] = true
+	}
+	return repositories, nil
+}
+
+// cloneRepositories clones the additional repositories listed in the manifest
+// next to the primary repository. Each repository runs through the same clone
+// scripts as the primary one, in parallel up to the configured concurrency.
+func cloneRepositories(ctx context.Context) error {
+	if os.Getenv("PLUGIN_ONLY_COPY_FILE_CONTENT") == "true" {
+		return nil
+	}
+
+	repositories, err := loadRepositories()
+	if err != nil || len(repositories) == 0 {
+		return err
+	}
+
+	concurrency := defaultRepositoriesConcurrency
+	if value := os.Getenv("PLUGIN_REPOSITORIES_CONCURRENCY"); value != "" {
+		if concurrency, err = strconv.Atoi(value); err != nil || concurrency < 1 {
+			return fmt.Errorf("invalid PLUGIN_REPOSITORIES_CONCURRENCY %q", value)
+		}
+	}
+
+	workspace, err := getWorkspaceDirectory()
+	if err != nil {
+		return err
+	}
+
+	reports := make([]RepositoryReport, len(repositories))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var outputMu sync.Mutex
+
+	for i, repo := range repositories {
+		wg.Add(1)
+		go func(i int, repo Repository) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			var output bytes.Buffer
+			reports[i] = cloneRepository(ctx, workspace, i, repo, &output)
+
+			// Print the buffered output in one piece so parallel clones do not interleave
+			outputMu.Lock()
+			defer outputMu.Unlock()
+			fmt.Fprintf(os.Stdout, "[repository %s] %s @ %s\n", repo.Path, repo.URL, repo.Ref)
+			os.Stdout.Write(output.Bytes())
+		}(i, repo)
+	}
+	wg.Wait()
+
+	if err := updateCloneReport(func(r *CloneReport) { r.Repositories = reports }); err != nil {
+		slog.Warn("Failed to update clone report", "error", err)
+	}
+
+	var failed []string
+	for _, report := range reports {
+		if report.Error != "" {
+			failed = append(failed, report.Path)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to clone repositories: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// cloneRepository runs the clone script for a single additional repository.
+// A failed clone is retried PLUGIN_REPOSITORIES_RETRIES times with an
+// exponential backoff, as PLUGIN_SUBMODULE_RETRIES does for submodules.
+func cloneRepository(ctx context.Context, workspace string, index int, repo Repository, output *bytes.Buffer) RepositoryReport {
+	target := filepath.Join(workspace, repo.Path)
+	report := RepositoryReport{URL: repo.URL, Ref: repo.Ref, Path: target}
+
+	retries := 0
+	if value := os.Getenv("PLUGIN_REPOSITORIES_RETRIES"); value != "" {
+		var err error
+		if retries, err = strconv.Atoi(value); err != nil || retries < 0 {
+			report.Error = fmt.Sprintf("invalid PLUGIN_REPOSITORIES_RETRIES %q", value)
+			return report
+		}
+	}
+
+	delay := repositoryRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := runRepositoryClone(ctx, repo, target, index, output)
+		if err == nil {
+			break
+		}
+		if attempt > retries || ctx.Err() != nil || errors.Is(err, errNotABranch) {
+			slog.Error("Failed to clone repository", "url", repo.URL, "path", target, "error", err)
+			report.Error = err.Error()
+			return report
+		}
+		fmt.Fprintf(output, "[INFO] repository clone failed, retrying in %s (attempt %d of %d)\n", delay, attempt, retries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		delay *= 2
+	}
+
+	report.Commit, _ = runGit(ctx, target, "rev-parse", "HEAD")
+	return report
+}
+
+// runRepositoryClone creates the target directory and runs the clone script in it
+func runRepositoryClone(ctx context.Context, repo Repository, target string, index int, output *bytes.Buffer) error {
+	env, err := repositoryCloneEnv(repo, target, index)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, mode); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", target, err)
+	}
+
+	cmd, err := cloneScriptCommand(ctx)
+	if err != nil {
+		return err
+	}
+	start := output.Len()
+	err = runCmds([]*exec.Cmd{cmd}, env, target, output, output)
+
+	// A bare ref is fetched as a branch, which fails for a tag
+	branch := strings.TrimPrefix(repo.Ref, "refs/heads/")
+	if err != nil && !strings.HasPrefix(branch, "refs/") && !commitSHA.MatchString(branch) &&
+		strings.Contains(output.String()[start:], "couldn't find remote ref refs/heads/"+branch) {
+		return fmt.Errorf("ref %s %w of %s, tags are given as refs/tags/%s", repo.Ref, errNotABranch, repo.URL, branch)
+	}
+	return err
+}
+
+// repositoryCloneEnv builds the environment of the clone script for an
+// additional repository from the primary build environment
+func repositoryCloneEnv(repo Repository, target string, index int) ([]string, error) {
+	env := scriptEnv()
+	for _, key := range repositoryCloneUnsetEnv {
+		env = unsetEnv(env, key)
+	}
+
+	env = setEnv(env, "DRONE_GIT_ADDITIONAL_REPOSITORY", "true")
+	env = setEnv(env, "DRONE_REMOTE_URL", repo.URL)
+	env = setEnv(env, "DRONE_WORKSPACE", target)
+	if repo.Depth > 0 {
+		env = setEnv(env, "PLUGIN_DEPTH", strconv.Itoa(repo.Depth))
+	}
+
+	// Every repository gets its own credentials and git config folder so the
+	// parallel clones cannot overwrite each other
+	env = setEnv(env, "HARNESS_GIT_CONFIG_FOLDER",
+		filepath.Join(globalTmpDir, "repositories", strconv.Itoa(index)))
+
+	ref := repo.Ref
+	switch {
+	case strings.HasPrefix(ref, "refs/tags/"):
+		env = setEnv(env, "DRONE_BUILD_EVENT", "tag")
+		env = setEnv(env, "DRONE_COMMIT_REF", ref)
+		env = setEnv(env, "DRONE_TAG", strings.TrimPrefix(ref, "refs/tags/"))
+	case strings.HasPrefix(ref, "refs/") && !strings.HasPrefix(ref, "refs/heads/"):
+		// Pull and merge request refs are fetched as they are and checked out
+		// on a local branch named after the ref
+		env = setEnv(env, "DRONE_BUILD_EVENT", "pull_request")
+		env = setEnv(env, "PLUGIN_PR_CLONE_STRATEGY", "SourceBranch")
+		env = setEnv(env, "DRONE_COMMIT_REF", ref)
+		env = setEnv(env, "DRONE_COMMIT_SHA", "FETCH_HEAD")
+		env = setEnv(env, "DRONE_SOURCE_BRANCH", strings.TrimPrefix(ref, "refs/"))
+	case commitSHA.MatchString(ref):
+		env = setEnv(env, "DRONE_BUILD_EVENT", "push")
+		env = setEnv(env, "DRONE_COMMIT_SHA", ref)
+	default:
+		env = setEnv(env, "DRONE_BUILD_EVENT", "push")
+		env = setEnv(env, "DRONE_COMMIT_BRANCH", strings.TrimPrefix(ref, "refs/heads/"))
+	}
+
+	if repo.Credentials == "" {
+		return env, nil // Reuse the credentials of the primary repository
+	}
+
+	prefix := strings.ToUpper(repo.Credentials)
+	username := os.Getenv(prefix + "_USERNAME")
+	password := os.Getenv(prefix + "_PASSWORD")
+	sshKey := os.Getenv(prefix + "_SSH_KEY")
+	if password == "" && sshKey == "" {
+		return nil, fmt.Errorf("credentials %s: neither %s_PASSWORD nor %s_SSH_KEY is set",
+			repo.Credentials, prefix, prefix)
+	}
+
+	env = setEnv(env, "DRONE_NETRC_MACHINE", remoteHost(repo.URL))
+	env = setEnv(env, "DRONE_NETRC_USERNAME", username)
+	env = setEnv(env, "DRONE_NETRC_PASSWORD", password)
+	env = unsetEnv(env, "DRONE_NETRC_PORT")
+	if u, err := url.Parse(repo.URL); err == nil && u.Port() != "" {
+		env = setEnv(env, "DRONE_NETRC_PORT", u.Port())
+	}
+	env = unsetEnv(env, "DRONE_SSH_KEY")
+	env = unsetEnv(env, "DRONE_SSH_KEY_NAME")
+	env = unsetEnv(env, "DRONE_SSH_PASSPHRASE")
+	env = unsetEnv(env, "PLUGIN_SSH_CERTIFICATE")
+	// The SSH agent only holds the key of the primary repository
+	env = unsetEnv(env, "DRONE_SSH_AGENT")
+	env = unsetEnv(env, "SSH_AUTH_SOCK")
+	if sshKey != "" {
+		key, err := parseSSHKey(sshKey, os.Getenv(prefix+"_SSH_PASSPHRASE"))
+		if err != nil {
+			return nil, fmt.Errorf("credentials %s: invalid %s_SSH_KEY: %v", repo.Credentials, prefix, err)
+		}
+		env = setEnv(env, "DRONE_SSH_KEY", string(key.PEM))
+		env = setEnv(env, "DRONE_SSH_KEY_NAME", key.Filename())
+
+		if certificate := os.Getenv(prefix + "_SSH_CERTIFICATE"); certificate != "" {
+			cert, err := parseSSHCertificate(certificate, key, os.Getenv("PLUGIN_SSH_CERTIFICATE_PRINCIPAL"), time.Now())
+			if err != nil {
+				return nil, fmt.Errorf("credentials %s: invalid %s_SSH_CERTIFICATE: %v", repo.Credentials, prefix, err)
+			}
+			env = setEnv(env, "PLUGIN_SSH_CERTIFICATE", string(ssh.MarshalAuthorizedKey(cert)))
+		}
+	}
+	return env, nil
+}
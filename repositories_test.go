@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadRepositories(t *testing.T) {
+	os.Setenv("PLUGIN_REPOSITORIES", `
+- url: https://github.com/octocat/configs.git
+  ref: main
+  path: configs
+  depth: 1
+- url: git@github.com:octocat/protos.git
+  ref: refs/tags/v1.2.0
+  path: protos
+  credentials: protos
+`)
+	defer os.Unsetenv("PLUGIN_REPOSITORIES")
+
+	repositories, err := loadRepositories()
+	require.NoError(t, err)
+	require.Len(t, repositories, 2)
+	assert.Equal(t, "configs", repositories[0].Path)
+	assert.Equal(t, 1, repositories[0].Depth)
+	assert.Equal(t, "refs/tags/v1.2.0", repositories[1].Ref)
+	assert.Equal(t, "protos", repositories[1].Credentials)
+
+	// JSON, as passed by the plugin settings, is accepted as well
+	os.Setenv("PLUGIN_REPOSITORIES", `[{"url": "https://github.com/octocat/configs.git", "ref": "main", "path": "configs"}]`)
+	repositories, err = loadRepositories()
+	require.NoError(t, err)
+	require.Len(t, repositories, 1)
+}
+
+func TestLoadRepositories_Invalid(t *testing.T) {
+	defer os.Unsetenv("PLUGIN_REPOSITORIES")
+
+	tests := map[string]string{
+		"missing url":    `[{"ref": "main", "path": "a"}]`,
+		"missing ref":    `[{"url": "https://example.com/a.git", "path": "a"}]`,
+		"absolute path":  `[{"url": "https://example.com/a.git", "ref": "main", "path": "/a"}]`,
+		"parent path":    `[{"url": "https://example.com/a.git", "ref": "main", "path": "../a"}]`,
+		"escaping path":  `[{"url": "https://example.com/a.git", "ref": "main", "path": "a/../../b"}]`,
+		"duplicate path": `[{"url": "https://example.com/a.git", "ref": "main", "path": "a"}, {"url": "https://example.com/b.git", "ref": "main", "path": "a/"}]`,
+	}
+	for name, manifest := range tests {
+		t.Run(name, func(t *testing.T) {
+			os.Setenv("PLUGIN_REPOSITORIES", manifest)
+			_, err := loadRepositories()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRepositoryCloneEnv(t *testing.T) {
+	os.Setenv("DRONE_COMMIT_SHA", "94b4a1710d1581b8b00c5f7b077026eae3c07646")
+	os.Setenv("PROTOS_USERNAME", "bot")
+	os.Setenv("PROTOS_PASSWORD", "secret")
+	defer func() {
+		os.Unsetenv("DRONE_COMMIT_SHA")
+		os.Unsetenv("PROTOS_USERNAME")
+		os.Unsetenv("PROTOS_PASSWORD")
+	}()
+
+	env, err := repositoryCloneEnv(Repository{
+		URL:         "https://git.example.com:8443/octocat/protos.git",
+		Ref:         "refs/tags/v1.2.0",
+		Path:        "protos",
+		Credentials: "protos",
+	}, "/harness/protos", 1)
+	require.NoError(t, err)
+
+	assert.Contains(t, env, "DRONE_BUILD_EVENT=tag")
+	assert.Contains(t, env, "DRONE_TAG=v1.2.0")
+	assert.Contains(t, env, "DRONE_NETRC_MACHINE=git.example.com")
+	assert.Contains(t, env, "DRONE_NETRC_PORT=8443")
+	assert.Contains(t, env, "DRONE_NETRC_USERNAME=bot")
+	assert.Contains(t, env, "DRONE_NETRC_PASSWORD=secret")
+	assert.NotContains(t, env, "DRONE_COMMIT_SHA=94b4a1710d1581b8b00c5f7b077026eae3c07646")
+
+	_, err = repositoryCloneEnv(Repository{URL: "https://example.com/a.git", Ref: "main", Path: "a", Credentials: "missing"}, "/harness/a", 0)
+	assert.Error(t, err)
+
+	// pull and merge request refs are not branches
+	env, err = repositoryCloneEnv(Repository{URL: "https://example.com/a.git", Ref: "refs/merge-requests/7/head", Path: "a"}, "/harness/a", 0)
+	require.NoError(t, err)
+	assert.Contains(t, env, "DRONE_BUILD_EVENT=pull_request")
+	assert.Contains(t, env, "DRONE_COMMIT_REF=refs/merge-requests/7/head")
+	assert.Contains(t, env, "DRONE_SOURCE_BRANCH=merge-requests/7/head")
+	assert.NotContains(t, env, "DRONE_COMMIT_BRANCH=refs/merge-requests/7/head")
+}
+
+func TestCloneRepositories(t *testing.T) {
+	remote := newTestRepo(t)
+	gitCmd(t, remote, "tag", "v1.0.0")
+	gitCmd(t, remote, "checkout", "-q", "-b", "feature")
+	writeTestFile(t, remote, "feature.txt", "feature\n")
+	gitCmd(t, remote, "add", ".")
+	gitCmd(t, remote, "commit", "-q", "-m", "add feature")
+	featureSHA := gitCmd(t, remote, "rev-parse", "HEAD")
+	gitCmd(t, remote, "update-ref", "refs/pull/1/head", featureSHA)
+
+	workspace := t.TempDir()
+	reportFile := filepath.Join(t.TempDir(), "clone-report.json")
+
+	var err error
+	globalTmpDir, err = os.MkdirTemp("", "drone-git-test-*")
+	require.NoError(t, err)
+	defer cleanupTempDir()
+	require.NoError(t, writeScriptsToTemp(globalTmpDir))
+
+	os.Setenv("DRONE_WORKSPACE", workspace)
+	os.Setenv("PLUGIN_CLONE_REPORT_FILE", reportFile)
+	os.Setenv("PLUGIN_REPOSITORIES", `
+- url: `+remote+`
+  ref: feature
+  path: companion/feature
+- url: `+remote+`
+  ref: refs/tags/v1.0.0
+  path: companion/release
+- url: `+remote+`
+  ref: refs/pull/1/head
+  path: companion/pull
+`)
+	defer func() {
+		os.Unsetenv("DRONE_WORKSPACE")
+		os.Unsetenv("PLUGIN_CLONE_REPORT_FILE")
+		os.Unsetenv("PLUGIN_REPOSITORIES")
+	}()
+
+	require.NoError(t, cloneRepositories(context.Background()))
+
+	assert.FileExists(t, filepath.Join(workspace, "companion", "feature", "feature.txt"))
+	assert.FileExists(t, filepath.Join(workspace, "companion", "release", "README.md"))
+	assert.NoFileExists(t, filepath.Join(workspace, "companion", "release", "feature.txt"))
+
+	report := &CloneReport{}
+	require.NoError(t, updateCloneReport(func(r *CloneReport) { *report = *r }))
+	require.Len(t, report.Repositories, 3)
+	assert.Equal(t, featureSHA, report.Repositories[0].Commit)
+	assert.Empty(t, report.Repositories[1].Error)
+	assert.Equal(t, featureSHA, report.Repositories[2].Commit)
+}
+
+func TestCloneRepository_Retries(t *testing.T) {
+	var err error
+	globalTmpDir, err = os.MkdirTemp("", "drone-git-test-*")
+	require.NoError(t, err)
+	defer cleanupTempDir()
+	require.NoError(t, writeScriptsToTemp(globalTmpDir))
+
+	previous := repositoryRetryDelay
+	repositoryRetryDelay = time.Millisecond
+	defer func() { repositoryRetryDelay = previous }()
+	setTestEnv(t, map[string]string{"PLUGIN_REPOSITORIES_RETRIES": "2"})
+
+	var output bytes.Buffer
+	missing := filepath.Join(t.TempDir(), "missing.git")
+	report := cloneRepository(context.Background(), t.TempDir(), 0, Repository{URL: missing, Ref: "main", Path: "missing"}, &output)
+	assert.NotEmpty(t, report.Error)
+	assert.Contains(t, output.String(), "repository clone failed, retrying in 1ms (attempt 1 of 2)")
+	assert.Contains(t, output.String(), "repository clone failed, retrying in 2ms (attempt 2 of 2)")
+}
+
+func TestCloneRepository_Refs(t *testing.T) {
+	remote := newTestRepo(t)
+	first := gitCmd(t, remote, "rev-parse", "HEAD")
+	gitCmd(t, remote, "tag", "v1.2.0")
+	second := commitTestFile(t, remote, "a.txt", "a\n", "second")
+	commitTestFile(t, remote, "b.txt", "b\n", "third")
+
+	var err error
+	globalTmpDir, err = os.MkdirTemp("", "drone-git-test-*")
+	require.NoError(t, err)
+	defer cleanupTempDir()
+	require.NoError(t, writeScriptsToTemp(globalTmpDir))
+	setTestEnv(t, map[string]string{"PLUGIN_REPOSITORIES_RETRIES": "2"})
+
+	// A commit is fetched with the depth of the repository
+	workspace := t.TempDir()
+	var output bytes.Buffer
+	report := cloneRepository(context.Background(), workspace, 0, Repository{URL: "file://" + remote, Ref: second, Path: "pinned", Depth: 1}, &output)
+	require.Empty(t, report.Error, output.String())
+	assert.Equal(t, second, report.Commit)
+	assert.Equal(t, "1", gitCmd(t, filepath.Join(workspace, "pinned"), "rev-list", "--count", "HEAD"))
+
+	// A bare tag name is not a branch and fails without retries
+	output.Reset()
+	report = cloneRepository(context.Background(), workspace, 1, Repository{URL: "file://" + remote, Ref: "v1.2.0", Path: "tag"}, &output)
+	assert.Equal(t, "ref v1.2.0 is not a branch of file://"+remote+", tags are given as refs/tags/v1.2.0", report.Error)
+	assert.NotContains(t, output.String(), "retrying")
+
+	output.Reset()
+	report = cloneRepository(context.Background(), workspace, 2, Repository{URL: "file://" + remote, Ref: "refs/tags/v1.2.0", Path: "release"}, &output)
+	require.Empty(t, report.Error, output.String())
+	assert.Equal(t, first, report.Commit)
+}
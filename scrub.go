@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// CredentialsReport records the credential material removed after the clone
+type CredentialsReport struct {
+	Persisted bool     `json:"persisted,omitempty"`
+	Removed   []string `json:"removed,omitempty"`
+}
+
+// rewriteWithCredentials matches the url.<base>.insteadOf keys whose base
+// URL carries credentials
+var rewriteWithCredentials = regexp.MustCompile(`^url\.https?://[^/@]+@.*\.insteadof$`)
+
+// scrubCredentials removes the credential material the clone scripts wrote,
+// once the clone is done: the netrc file, the SSH key, certificate and known
+// hosts, the AWS credentials and the credential and proxy settings of the git
+// config. Credentials are kept when DRONE_PERSIST_CREDS or
+// PLUGIN_PERSIST_CREDENTIALS is set. What was removed is logged and recorded
+// in the clone report.
+func scrubCredentials(ctx context.Context) {
+	if os.Getenv("PLUGIN_ONLY_COPY_FILE_CONTENT") == "true" {
+		return
+	}
+
+	report := &CredentialsReport{}
+	if os.Getenv("DRONE_PERSIST_CREDS") != "" || os.Getenv("PLUGIN_PERSIST_CREDENTIALS") == "true" {
+		fmt.Println("[INFO] keeping the clone credentials for the following steps")
+		report.Persisted = true
+	} else {
+		report.Removed = removeCredentialFiles(scriptHome())
+		report.Removed = append(report.Removed, removeCredentialConfig(ctx, scriptHome())...)
+		for _, item := range report.Removed {
+			fmt.Printf("[INFO] removed %s\n", item)
+		}
+	}
+
+	if err := updateCloneReport(func(r *CloneReport) { r.Credentials = report }); err != nil {
+		slog.Warn("Failed to update clone report", "error", err)
+	}
+}
+
+// scriptHome returns the home directory the clone scripts write the
+// credentials to
+func scriptHome() string {
+	if folder := os.Getenv("HARNESS_GIT_CONFIG_FOLDER"); folder != "" {
+		return folder
+	}
+	if runtime.GOOS == "windows" {
+		return os.Getenv("USERPROFILE")
+	}
+	if info, err := os.Stat("/home/drone"); err == nil && info.IsDir() {
+		return "/home/drone"
+	}
+	home, _ := os.UserHomeDir()
+	return home
+}
+
+// removeCredentialFiles removes the credential files written by the clone
+// scripts and returns the ones that existed
+func removeCredentialFiles(home string) []string {
+	var files []string
+
+	if os.Getenv("DRONE_NETRC_MACHINE") != "" || os.Getenv("PLUGIN_CREDENTIALS") != "" || os.Getenv("PLUGIN_CREDENTIALS_FILE") != "" {
+		if runtime.GOOS == "windows" {
+			files = append(files, filepath.Join(home, "_netrc"))
+		} else {
+			files = append(files, filepath.Join(home, ".netrc"))
+		}
+	}
+
+	if os.Getenv("DRONE_SSH_KEY") != "" || os.Getenv("DRONE_SSH_AGENT") == "true" {
+		sshDir := filepath.Join(home, ".ssh")
+		if runtime.GOOS == "windows" && os.Getenv("HARNESS_GIT_CONFIG_FOLDER") == "" {
+			sshDir = `C:\.ssh`
+		}
+		key := os.Getenv("DRONE_SSH_KEY_NAME")
+		if key == "" {
+			key = "id_rsa"
+		}
+		files = append(files,
+			filepath.Join(sshDir, key),
+			filepath.Join(sshDir, key+"-cert.pub"),
+			filepath.Join(sshDir, "known_hosts"),
+			filepath.Join(sshDir, "keyscan.err"),
+		)
+	}
+
+	if os.Getenv("DRONE_AWS_ACCESS_KEY") != "" {
+		credentials := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+		if credentials == "" || os.Getenv("HARNESS_GIT_CONFIG_FOLDER") != "" {
+			credentials = filepath.Join(home, ".aws", "credentials")
+		}
+		files = append(files, credentials)
+	}
+
+	var removed []string
+	for _, file := range files {
+		if err := os.Remove(file); err == nil {
+			removed = append(removed, file)
+		} else if !os.IsNotExist(err) {
+			slog.Warn("Failed to remove credentials", "file", file, "error", err)
+		}
+	}
+	return removed
+}
+
+// removeCredentialConfig unsets the credential helper, proxy and credential
+// carrying URL rewrites the clone scripts added to the git config and returns
+// the removed keys
+func removeCredentialConfig(ctx context.Context, home string) []string {
+	global := filepath.Join(home, ".gitconfig")
+	if file := os.Getenv("GIT_CONFIG_GLOBAL"); file != "" && os.Getenv("HARNESS_GIT_CONFIG_FOLDER") == "" {
+		global = file
+	}
+
+	// The scripts write the proxy and the URL rewrites to the repository
+	// config in isolated mode
+	workspace, _ := getWorkspaceDirectory()
+	scopeArgs := []string{"--file", global}
+	scope := global
+	if os.Getenv("HARNESS_GIT_CONFIG_FOLDER") != "" {
+		scopeArgs = []string{"--local"}
+		scope = filepath.Join(workspace, ".git", "config")
+	}
+
+	var keys []string
+	if os.Getenv("DRONE_AWS_ACCESS_KEY") != "" {
+		keys = append(keys, "credential.helper", "credential.usehttppath")
+	}
+	removed := unsetGitConfig(ctx, workspace, []string{"--file", global}, global, keys...)
+
+	// The scripts record the proxy and the URL rewrites they write under
+	// drone-git.*, settings configured by other means are kept
+	args := append([]string{"config"}, scopeArgs...)
+	if proxy, err := runGit(ctx, workspace, append(args, "--get", "drone-git.httpProxy")...); err == nil {
+		removed = append(removed, unsetGitConfigValue(ctx, workspace, scopeArgs, scope, "http.proxy", proxy)...)
+		unsetGitConfigValue(ctx, workspace, scopeArgs, scope, "drone-git.httpProxy", proxy)
+	}
+	if rules, err := runGit(ctx, workspace, append(args, "--get-all", "drone-git.urlRewrite")...); err == nil {
+		for _, rule := range strings.Split(rules, "\n") {
+			prefix, replacement, _ := strings.Cut(rule, "=")
+			key := "url." + replacement + ".insteadof"
+			if !rewriteWithCredentials.MatchString(strings.ToLower(key)) {
+				continue
+			}
+			removed = append(removed, unsetGitConfigValue(ctx, workspace, scopeArgs, scope, key, prefix)...)
+			unsetGitConfigValue(ctx, workspace, scopeArgs, scope, "drone-git.urlRewrite", rule)
+		}
+	}
+	return removed
+}
+
+// unsetGitConfig removes every value of the keys from the config selected by
+// scopeArgs and returns the keys that were set, qualified with file
+func unsetGitConfig(ctx context.Context, dir string, scopeArgs []string, file string, keys ...string) []string {
+	var removed []string
+	for _, key := range keys {
+		args := append([]string{"config"}, scopeArgs...)
+		if _, err := runGit(ctx, dir, append(args, "--get-all", key)...); err != nil {
+			continue // Not set
+		}
+		if _, err := runGit(ctx, dir, append(args, "--unset-all", key)...); err != nil {
+			slog.Warn("Failed to remove credential config", "key", key, "error", err)
+			continue
+		}
+		removed = append(removed, fmt.Sprintf("%s from %s", maskURL(key), file))
+	}
+	return removed
+}
+
+// unsetGitConfigValue removes the values of key equal to value from the
+// config selected by scopeArgs and returns the key when it was set,
+// qualified with file
+func unsetGitConfigValue(ctx context.Context, dir string, scopeArgs []string, file string, key, value string) []string {
+	args := append([]string{"config"}, scopeArgs...)
+	if _, err := runGit(ctx, dir, append(args, "--fixed-value", "--get-all", key, value)...); err != nil {
+		return nil // Not set
+	}
+	if _, err := runGit(ctx, dir, append(args, "--fixed-value", "--unset-all", key, value)...); err != nil {
+		slog.Warn("Failed to remove credential config", "key", key, "error", err)
+		return nil
+	}
+	return []string{fmt.Sprintf("%s from %s", maskURL(key), file)}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var semverPattern = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-([0-9A-Za-z.-]+))?(?:\+([0-9A-Za-z.-]+))?$`)
+
+// Version is a semantic version
+type Version struct {
+	Major      int
+	Minor      int
+	Patch      int
+	PreRelease string
+}
+
+// parseVersion parses a semantic version, ignoring build metadata
+func parseVersion(s string) (Version, bool) {
+	match := semverPattern.FindStringSubmatch(s)
+	if match == nil {
+		return Version{}, false
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	patch, _ := strconv.Atoi(match[3])
+	return Version{Major: major, Minor: minor, Patch: patch, PreRelease: match[4]}, true
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.PreRelease != "" {
+		s += "-" + v.PreRelease
+	}
+	return s
+}
+
+// Less orders release versions; pre-releases sort before their release
+func (v Version) Less(o Version) bool {
+	switch {
+	case v.Major != o.Major:
+		return v.Major < o.Major
+	case v.Minor != o.Minor:
+		return v.Minor < o.Minor
+	case v.Patch != o.Patch:
+		return v.Patch < o.Patch
+	}
+	return v.PreRelease != "" && (o.PreRelease == "" || v.PreRelease < o.PreRelease)
+}
+
+// Bump returns the next version for the given bump: major, minor or patch
+func (v Version) Bump(bump string) Version {
+	switch bump {
+	case "major":
+		return Version{Major: v.Major + 1}
+	case "minor":
+		return Version{Major: v.Major, Minor: v.Minor + 1}
+	case "patch":
+		return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+	}
+	return v
+}
+
+// SemverResult is the version information computed for the build
+type SemverResult struct {
+	Tag        string
+	Current    Version
+	Next       Version
+	Bump       string
+	Commits    int
+	PreRelease string
+}
+
+// tagVersion parses tag as a release version. A configured prefix must be
+// present, the default "v" prefix is optional.
+func tagVersion(tag, prefix string) (Version, bool) {
+	if prefix == "" {
+		tag = strings.TrimPrefix(tag, "v")
+	} else if tag = strings.TrimPrefix(tag, prefix); tag == "" {
+		return Version{}, false
+	}
+	v, ok := parseVersion(tag)
+	if !ok || v.PreRelease != "" {
+		return Version{}, false
+	}
+	return v, true
+}
+
+// latestVersionTag returns the highest release tag reachable from HEAD. The
+// filter arguments are passed to git tag to narrow down the candidates.
+func latestVersionTag(ctx context.Context, dir, prefix string, filter ...string) (string, Version, error) {
+	out, err := runGit(ctx, dir, append([]string{"tag", "--merged", "HEAD"}, filter...)...)
+	if err != nil {
+		return "", Version{}, err
+	}
+
+	var latest string
+	var version Version
+	for _, tag := range strings.Fields(out) {
+		if v, ok := tagVersion(tag, prefix); ok && (latest == "" || version.Less(v)) {
+			latest, version = tag, v
+		}
+	}
+	return latest, version, nil
+}
+
+// versionBump derives the bump implied by conventional commit messages
+func versionBump(messages []string) string {
+	bump := ""
+	for _, message := range messages {
+		commit, ok := parseConventionalCommit(message)
+		switch {
+		case !ok:
+		case commit.Breaking:
+			return "major"
+		case commit.Type == "feat":
+			bump = "minor"
+		case bump == "" && (commit.Type == "fix" || commit.Type == "perf"):
+			bump = "patch"
+		}
+	}
+	if bump == "" && len(messages) > 0 {
+		bump = "patch" // Every change produces a new version
+	}
+	return bump
+}
+
+// checkoutRefspecs returns the refspecs of the ref the clone scripts checked
+// out: the tag, the pull request ref with its target branch or the branch
+func checkoutRefspecs() []string {
+	ref := os.Getenv("DRONE_COMMIT_REF")
+	switch cloneType() {
+	case "tag":
+		tag := os.Getenv("DRONE_TAG")
+		if tag == "" {
+			tag = strings.TrimPrefix(ref, "refs/tags/")
+		}
+		return []string{fmt.Sprintf("+refs/tags/%s:refs/tags/%s", tag, tag)}
+	case "pull_request":
+		var refspecs []string
+		if target := os.Getenv("DRONE_TARGET_BRANCH"); target != "" {
+			refspecs = append(refspecs, fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", target, target))
+		}
+		if ref != "" {
+			refspecs = append(refspecs, ref)
+		}
+		return refspecs
+	}
+	if branch := os.Getenv("DRONE_COMMIT_BRANCH"); branch != "" {
+		return []string{fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", branch, branch)}
+	}
+	return nil
+}
+
+// computeSemver finds the latest release tag reachable from HEAD, deepening
+// the shallow history of the checked out ref until one is found, and derives
+// the next version from the conventional commits since that tag
+func computeSemver(ctx context.Context, dir string) (*SemverResult, error) {
+	prefix := os.Getenv("PLUGIN_SEMVER_TAG_PREFIX")
+
+	refspecs := checkoutRefspecs()
+
+	if err := fetchTags(ctx, dir); err != nil {
+		return nil, err
+	}
+
+	var tag string
+	var current Version
+	var err error
+	check := func() bool {
+		tag, current, err = latestVersionTag(ctx, dir, prefix)
+		return err != nil || tag != ""
+	}
+	if deepenErr := deepenUntil(ctx, dir, refspecs, false, check); deepenErr != nil {
+		return nil, deepenErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tag == "" && isShallow(ctx, dir) {
+		fmt.Println("[INFO] no previous release tag in the history of the shallow clone")
+	}
+
+	revs := "HEAD"
+	if tag != "" {
+		revs = "refs/tags/" + tag + "..HEAD"
+	} else if initial := os.Getenv("PLUGIN_SEMVER_INITIAL_VERSION"); initial != "" {
+		var ok bool
+		if current, ok = parseVersion(initial); !ok {
+			return nil, fmt.Errorf("invalid PLUGIN_SEMVER_INITIAL_VERSION %q", initial)
+		}
+	}
+
+	out, err := runGit(ctx, dir, "log", "-z", "--format=%B", revs, "--")
+	if err != nil {
+		return nil, err
+	}
+	var messages []string
+	if out = strings.TrimSuffix(out, "\x00"); out != "" {
+		messages = strings.Split(out, "\x00")
+	}
+
+	result := &SemverResult{
+		Tag:     tag,
+		Current: current,
+		Bump:    versionBump(messages),
+		Commits: len(messages),
+	}
+	result.Next = current.Bump(result.Bump)
+
+	if result.Commits > 0 {
+		sha, err := runGit(ctx, dir, "rev-parse", "--short", "HEAD")
+		if err != nil {
+			return nil, err
+		}
+		id := os.Getenv("PLUGIN_SEMVER_PRERELEASE_ID")
+		if id == "" {
+			id = "rc"
+		}
+		pre := result.Next
+		pre.PreRelease = fmt.Sprintf("%s.%d", id, result.Commits)
+		result.PreRelease = pre.String() + "+" + sha
+	}
+	return result, nil
+}
+
+// outputs returns the version information as step outputs
+func (r *SemverResult) outputs() map[string]string {
+	return map[string]string{
+		"SEMVER_TAG":               r.Tag,
+		"SEMVER_CURRENT":           r.Current.String(),
+		"SEMVER_NEXT":              r.Next.String(),
+		"SEMVER_BUMP":              r.Bump,
+		"SEMVER_PRERELEASE":        r.PreRelease,
+		"SEMVER_COMMITS_SINCE_TAG": strconv.Itoa(r.Commits),
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConventionalCommit(t *testing.T) {
+	tests := []struct {
+		message string
+		want    ConventionalCommit
+		ok      bool
+	}{
+		{"feat: add login", ConventionalCommit{Type: "feat", Description: "add login"}, true},
+		{"fix(api): handle nil\n\nbody", ConventionalCommit{Type: "fix", Scope: "api", Description: "handle nil"}, true},
+		{"refactor!: drop v1", ConventionalCommit{Type: "refactor", Breaking: true, Description: "drop v1"}, true},
+		{"feat: new config\n\nBREAKING CHANGE: the old format is gone", ConventionalCommit{Type: "feat", Breaking: true, Description: "new config"}, true},
+		{"Update README", ConventionalCommit{}, false},
+		{"Merge pull request #1 from a/b", ConventionalCommit{}, false},
+	}
+	for _, test := range tests {
+		got, ok := parseConventionalCommit(test.message)
+		assert.Equal(t, test.ok, ok, test.message)
+		assert.Equal(t, test.want, got, test.message)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	v, ok := parseVersion("1.2.3-rc.1+build.5")
+	require.True(t, ok)
+	assert.Equal(t, Version{Major: 1, Minor: 2, Patch: 3, PreRelease: "rc.1"}, v)
+	assert.Equal(t, "1.2.3-rc.1", v.String())
+
+	_, ok = parseVersion("1.2")
+	assert.False(t, ok)
+	_, ok = parseVersion("01.2.3")
+	assert.False(t, ok)
+
+	assert.True(t, Version{Major: 1, Minor: 9}.Less(Version{Major: 1, Minor: 10}))
+	assert.True(t, Version{Major: 1, PreRelease: "rc.1"}.Less(Version{Major: 1}))
+
+	base := Version{Major: 1, Minor: 2, Patch: 3}
+	assert.Equal(t, "2.0.0", base.Bump("major").String())
+	assert.Equal(t, "1.3.0", base.Bump("minor").String())
+	assert.Equal(t, "1.2.4", base.Bump("patch").String())
+	assert.Equal(t, "1.2.3", base.Bump("").String())
+}
+
+func TestTagVersion(t *testing.T) {
+	_, ok := tagVersion("v1.2.3", "")
+	assert.True(t, ok)
+	_, ok = tagVersion("1.2.3", "")
+	assert.True(t, ok)
+	_, ok = tagVersion("v1.2.3-beta", "")
+	assert.False(t, ok, "pre-release tags are not releases")
+	_, ok = tagVersion("v1.2.3", "release-")
+	assert.False(t, ok)
+	v, ok := tagVersion("release-1.2.3", "release-")
+	assert.True(t, ok)
+	assert.Equal(t, "1.2.3", v.String())
+}
+
+func TestVersionBump(t *testing.T) {
+	assert.Equal(t, "", versionBump(nil))
+	assert.Equal(t, "patch", versionBump([]string{"chore: deps", "docs: typo"}))
+	assert.Equal(t, "patch", versionBump([]string{"fix: crash"}))
+	assert.Equal(t, "minor", versionBump([]string{"fix: crash", "feat: thing"}))
+	assert.Equal(t, "major", versionBump([]string{"feat!: thing", "fix: crash"}))
+}
+
+func TestComputeSemver(t *testing.T) {
+	remote := newTestRepo(t)
+	commitTestFile(t, remote, "a.txt", "a\n", "feat: first feature")
+	gitCmd(t, remote, "tag", "v1.0.0")
+	commitTestFile(t, remote, "b.txt", "b\n", "fix: a bug")
+	gitCmd(t, remote, "tag", "-a", "-m", "release", "v1.1.0")
+	gitCmd(t, remote, "tag", "v2.0.0-rc.1")
+	gitCmd(t, remote, "tag", "unrelated")
+	commitTestFile(t, remote, "c.txt", "c\n", "fix: another bug")
+	commitTestFile(t, remote, "d.txt", "d\n", "feat(ui): a feature")
+	commitTestFile(t, remote, "e.txt", "e\n", "chore: cleanup")
+
+	// A shallow clone without tags, as produced by the clone scripts
+	dir := t.TempDir()
+	gitCmd(t, dir, "init", "-q")
+	gitCmd(t, dir, "remote", "add", "origin", "file://"+remote)
+	gitCmd(t, dir, "fetch", "-q", "--depth=1", "origin", "+refs/heads/main:")
+	gitCmd(t, dir, "checkout", "-q", "FETCH_HEAD")
+
+	t.Setenv("DRONE_BUILD_EVENT", "push")
+	t.Setenv("DRONE_COMMIT_BRANCH", "main")
+
+	result, err := computeSemver(context.Background(), dir)
+	require.NoError(t, err)
+	sha := gitCmd(t, dir, "rev-parse", "--short", "HEAD")
+	assert.Equal(t, &SemverResult{
+		Tag:        "v1.1.0",
+		Current:    Version{Major: 1, Minor: 1},
+		Next:       Version{Major: 1, Minor: 2},
+		Bump:       "minor",
+		Commits:    3,
+		PreRelease: "1.2.0-rc.3+" + sha,
+	}, result)
+}
+
+func TestComputeSemver_FullClone(t *testing.T) {
+	remote := newTestRepo(t)
+	gitCmd(t, remote, "tag", "v1.0.0")
+	commitTestFile(t, remote, "a.txt", "a\n", "feat: a feature")
+
+	// A full depth clone of the branch, which does not follow tags
+	dir := t.TempDir()
+	gitCmd(t, dir, "init", "-q")
+	gitCmd(t, dir, "remote", "add", "origin", "file://"+remote)
+	gitCmd(t, dir, "fetch", "-q", "origin", "+refs/heads/main:")
+	gitCmd(t, dir, "checkout", "-q", "FETCH_HEAD")
+	require.Empty(t, gitCmd(t, dir, "tag"))
+
+	t.Setenv("DRONE_BUILD_EVENT", "push")
+	t.Setenv("DRONE_COMMIT_BRANCH", "main")
+
+	result, err := computeSemver(context.Background(), dir)
+	require.NoError(t, err)
+	assert.Equal(t, "v1.0.0", result.Tag)
+	assert.Equal(t, "1.0.0", result.Current.String())
+	assert.Equal(t, "1.1.0", result.Next.String())
+	assert.Equal(t, 1, result.Commits)
+}
+
+func TestComputeSemver_NoTags(t *testing.T) {
+	dir := newTestRepo(t)
+	commitTestFile(t, dir, "a.txt", "a\n", "feat: first feature")
+	t.Setenv("PLUGIN_SEMVER_INITIAL_VERSION", "0.1.0")
+	t.Setenv("PLUGIN_SEMVER_PRERELEASE_ID", "dev")
+
+	result, err := computeSemver(context.Background(), dir)
+	require.NoError(t, err)
+	assert.Equal(t, "", result.Tag)
+	assert.Equal(t, "0.2.0", result.Next.String())
+	assert.Equal(t, 2, result.Commits)
+	assert.Contains(t, result.PreRelease, "0.2.0-dev.2+")
+}
+
+func TestComputeSemver_TagBuild(t *testing.T) {
+	dir := newTestRepo(t)
+	gitCmd(t, dir, "tag", "v3.1.4")
+
+	result, err := computeSemver(context.Background(), dir)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"SEMVER_TAG":               "v3.1.4",
+		"SEMVER_CURRENT":           "3.1.4",
+		"SEMVER_NEXT":              "3.1.4",
+		"SEMVER_BUMP":              "",
+		"SEMVER_PRERELEASE":        "",
+		"SEMVER_COMMITS_SINCE_TAG": "0",
+	}, result.outputs())
+}
+
+func TestComputeSemver_TagBuildDeepen(t *testing.T) {
+	remote := newTestRepo(t)
+	commitTestFile(t, remote, "a.txt", "a\n", "feat: a feature")
+	gitCmd(t, remote, "tag", "nightly")
+	gitCmd(t, remote, "checkout", "-q", "-b", "other")
+	other := commitTestFile(t, remote, "b.txt", "b\n", "fix: other branch")
+	gitCmd(t, remote, "checkout", "-q", "main")
+
+	// A shallow clone of a tag that is not a release
+	dir := t.TempDir()
+	gitCmd(t, dir, "init", "-q")
+	gitCmd(t, dir, "remote", "add", "origin", "file://"+remote)
+	gitCmd(t, dir, "fetch", "-q", "--depth=1", "origin", "+refs/tags/nightly:")
+	gitCmd(t, dir, "checkout", "-q", "FETCH_HEAD")
+
+	setTestEnv(t, map[string]string{
+		"DRONE_BUILD_EVENT":   "tag",
+		"DRONE_COMMIT_REF":    "refs/tags/nightly",
+		"DRONE_TAG":           "nightly",
+		"DRONE_COMMIT_BRANCH": "",
+	})
+
+	// Only the history of the tag is deepened, not every branch
+	result, err := computeSemver(context.Background(), dir)
+	require.NoError(t, err)
+	assert.Equal(t, "", result.Tag)
+	assert.Equal(t, 2, result.Commits)
+	assert.False(t, hasCommit(context.Background(), dir, other))
+	assert.Empty(t, gitCmd(t, dir, "branch", "-r"))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// defaultSkipCIPattern matches the usual directives asking CI not to build a
+// commit, such as [skip ci] or [ci skip]
+const defaultSkipCIPattern = `(?i)\[(skip[ -]ci|ci[ -]skip|no[ -]ci)\]`
+
+// skipCIEnabled reports whether commit messages should be inspected for
+// skip directives
+func skipCIEnabled() bool {
+	return os.Getenv("PLUGIN_SKIP_CI") == "true"
+}
+
+// skipCIPattern compiles PLUGIN_SKIP_CI_PATTERN or the default pattern
+func skipCIPattern() (*regexp.Regexp, error) {
+	pattern := os.Getenv("PLUGIN_SKIP_CI_PATTERN")
+	if pattern == "" {
+		pattern = defaultSkipCIPattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PLUGIN_SKIP_CI_PATTERN %q: %v", pattern, err)
+	}
+	return re, nil
+}
+
+// applySkipCI requests a skip when the commit message carries a skip
+// directive. With PLUGIN_SKIP_CI_SCOPE=range every commit of the pushed range
+// or pull request is inspected and the build is skipped only when all of them
+// carry a directive, otherwise only the head commit is inspected.
+func (p *postClone) applySkipCI() error {
+	re, err := skipCIPattern()
+	if err != nil {
+		return err
+	}
+
+	var messages []string
+	switch scope := os.Getenv("PLUGIN_SKIP_CI_SCOPE"); scope {
+	case "", "head":
+		head := "HEAD"
+		// The checked out commit may be the merge with the target branch
+		if sha := os.Getenv("DRONE_COMMIT_SHA"); sha != "" && hasCommit(p.ctx, p.dir, sha) {
+			head = sha
+		}
+		commit, err := readCommit(p.ctx, p.dir, head)
+		if err != nil {
+			return fmt.Errorf("cannot read commit message: %v", err)
+		}
+		messages = []string{commit.Message}
+	case "range":
+		if messages, err = p.rangeMessages(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid PLUGIN_SKIP_CI_SCOPE %q, expected head or range", scope)
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+	var directive string
+	for _, message := range messages {
+		match := re.FindString(message)
+		if match == "" {
+			return nil
+		}
+		directive = match
+	}
+
+	if len(messages) == 1 {
+		p.skip = append(p.skip, fmt.Sprintf("commit message contains %s", directive))
+	} else {
+		p.skip = append(p.skip, fmt.Sprintf("all %d commit messages contain a skip directive", len(messages)))
+	}
+	return nil
+}
+
+// rangeMessages returns the messages of the commits in the change range of
+// the build, or of the head commit when the build has no range
+func (p *postClone) rangeMessages() ([]string, error) {
+	changeRange, _, err := p.changes()
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine commit range: %v", err)
+	}
+
+	args := []string{"log", "-z", "--format=%B"}
+	switch {
+	case changeRange == nil:
+		args = append(args, "-1", "HEAD")
+	case hasCommit(p.ctx, p.dir, changeRange.Base):
+		args = append(args, changeRange.Base+".."+changeRange.Head)
+	default:
+		// The base of a root commit is the empty tree
+		args = append(args, changeRange.Head)
+	}
+
+	out, err := runGit(p.ctx, p.dir, append(args, "--")...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every message is terminated by a NUL byte
+	if out = strings.TrimSuffix(out, "\x00"); out == "" {
+		return nil, nil
+	}
+	return strings.Split(out, "\x00"), nil
+}
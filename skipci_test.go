@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipCIPattern(t *testing.T) {
+	re, err := skipCIPattern()
+	assert.NoError(t, err)
+
+	for _, message := range []string{"fix typo [skip ci]", "[CI SKIP] docs", "wip\n\n[no ci]", "[skip-ci]"} {
+		assert.True(t, re.MatchString(message), message)
+	}
+	for _, message := range []string{"skip ci", "fix [skip] ci", "[skipci]"} {
+		assert.False(t, re.MatchString(message), message)
+	}
+
+	t.Setenv("PLUGIN_SKIP_CI_PATTERN", "(")
+	_, err = skipCIPattern()
+	assert.Error(t, err)
+}
+
+func TestRunPostClone_SkipCI(t *testing.T) {
+	dir := newTestRepo(t)
+	before := gitCmd(t, dir, "rev-parse", "HEAD")
+	commitTestFile(t, dir, "a.txt", "a\n", "regular change")
+	commitTestFile(t, dir, "b.txt", "b\n", "docs only [skip ci]")
+
+	setTestEnv(t, map[string]string{
+		"DRONE_BUILD_EVENT":   "push",
+		"DRONE_COMMIT_BEFORE": before,
+		"PLUGIN_SKIP_CI":      "true",
+	})
+
+	t.Run("head", func(t *testing.T) {
+		outputs, reason := runPostCloneIn(t, dir)
+		assert.Equal(t, "true", outputs["SKIP"])
+		assert.Equal(t, "commit message contains [skip ci]", reason)
+	})
+
+	t.Run("range", func(t *testing.T) {
+		t.Setenv("PLUGIN_SKIP_CI_SCOPE", "range")
+
+		outputs, reason := runPostCloneIn(t, dir)
+		assert.Equal(t, "false", outputs["SKIP"])
+		assert.Empty(t, reason)
+	})
+
+	t.Run("range all skipped", func(t *testing.T) {
+		t.Setenv("PLUGIN_SKIP_CI_SCOPE", "range")
+		t.Setenv("DRONE_COMMIT_BEFORE", gitCmd(t, dir, "rev-parse", "HEAD~1"))
+
+		outputs, _ := runPostCloneIn(t, dir)
+		assert.Equal(t, "true", outputs["SKIP"])
+	})
+
+	t.Run("custom pattern", func(t *testing.T) {
+		t.Setenv("PLUGIN_SKIP_CI_PATTERN", `\[skip build\]`)
+
+		outputs, _ := runPostCloneIn(t, dir)
+		assert.Equal(t, "false", outputs["SKIP"])
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/exp/slog"
+)
+
+// SSHAgent serves the clone key from memory on a private unix socket
+type SSHAgent struct {
+	Socket   string
+	listener net.Listener
+	dir      string
+}
+
+// startSSHAgent loads the DRONE_SSH_KEY into an in-process SSH agent when
+// PLUGIN_SSH_AGENT is set, so the key never has to be written to disk. The
+// clone scripts reach the agent through SSH_AUTH_SOCK and learn from
+// DRONE_SSH_AGENT that no key file is needed. It returns nil when the agent
+// is not enabled.
+func startSSHAgent() (*SSHAgent, error) {
+	raw := os.Getenv("DRONE_SSH_KEY")
+	if os.Getenv("PLUGIN_SSH_AGENT") != "true" || raw == "" {
+		return nil, nil
+	}
+	if runtime.GOOS == "windows" {
+		slog.Warn("PLUGIN_SSH_AGENT is not supported on windows, the SSH key is written to disk")
+		return nil, nil
+	}
+
+	// The key was decrypted by configureSSHKey
+	key, err := ssh.ParseRawPrivateKey(normalizeSSHKey(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DRONE_SSH_KEY: %v", err)
+	}
+	// Like ssh-add, the agent offers the plain key and the certified key
+	keys := []agent.AddedKey{{PrivateKey: key, Comment: "drone-git"}}
+	if certificate := os.Getenv("PLUGIN_SSH_CERTIFICATE"); certificate != "" {
+		public, _, _, _, err := ssh.ParseAuthorizedKey([]byte(certificate))
+		if err != nil {
+			return nil, fmt.Errorf("invalid PLUGIN_SSH_CERTIFICATE: %v", err)
+		}
+		if cert, ok := public.(*ssh.Certificate); ok {
+			keys = append(keys, agent.AddedKey{PrivateKey: key, Certificate: cert, Comment: "drone-git"})
+		}
+	}
+
+	keyring := agent.NewKeyring()
+	for _, added := range keys {
+		if err := keyring.Add(added); err != nil {
+			return nil, fmt.Errorf("failed to add the SSH key to the agent: %v", err)
+		}
+	}
+
+	// A short path in the system temp directory stays below the socket path
+	// limit, the directory is only accessible to the current user
+	dir, err := os.MkdirTemp("", "drone-git-agent-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the SSH agent directory: %v", err)
+	}
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to start the SSH agent: %v", err)
+	}
+
+	a := &SSHAgent{Socket: socket, listener: listener, dir: dir}
+	go a.serve(keyring)
+
+	os.Setenv("SSH_AUTH_SOCK", socket)
+	os.Setenv("DRONE_SSH_AGENT", "true")
+	os.Unsetenv("DRONE_SSH_KEY")
+	fmt.Printf("[INFO] serving the SSH key from the in-process agent at %s\n", socket)
+	return a, nil
+}
+
+// serve answers the agent requests until the agent is stopped
+func (a *SSHAgent) serve(keyring agent.Agent) {
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn("SSH agent stopped", "error", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			agent.ServeAgent(keyring, conn)
+		}()
+	}
+}
+
+// Stop closes the agent socket and removes its directory
+func (a *SSHAgent) Stop() {
+	if a == nil {
+		return
+	}
+	a.listener.Close()
+	os.RemoveAll(a.dir)
+	os.Unsetenv("SSH_AUTH_SOCK")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestStartSSHAgent(t *testing.T) {
+	raw := testSSHKey(t, "ed25519", "")
+	key, err := parseSSHKey(raw, "")
+	require.NoError(t, err)
+	now := time.Now()
+
+	setTestEnv(t, map[string]string{
+		"PLUGIN_SSH_AGENT":       "true",
+		"DRONE_SSH_KEY":          string(key.PEM),
+		"PLUGIN_SSH_CERTIFICATE": testSSHCertificate(t, key, nil, now.Add(-time.Hour), now.Add(time.Hour)),
+		"DRONE_SSH_AGENT":        "",
+		"SSH_AUTH_SOCK":          "",
+	})
+
+	a, err := startSSHAgent()
+	require.NoError(t, err)
+	require.NotNil(t, a)
+
+	assert.Equal(t, a.Socket, os.Getenv("SSH_AUTH_SOCK"))
+	assert.Equal(t, "true", os.Getenv("DRONE_SSH_AGENT"))
+	_, ok := os.LookupEnv("DRONE_SSH_KEY")
+	assert.False(t, ok, "the key should not be passed to the scripts")
+
+	info, err := os.Stat(filepath.Dir(a.Socket))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm(), "only the current user may reach the agent")
+
+	conn, err := net.Dial("unix", a.Socket)
+	require.NoError(t, err)
+	keys, err := agent.NewClient(conn).List()
+	conn.Close()
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, key.PublicKey.Marshal(), keys[0].Marshal())
+	assert.Equal(t, ssh.CertAlgoED25519v01, keys[1].Type())
+
+	a.Stop()
+	_, err = os.Stat(a.Socket)
+	assert.True(t, os.IsNotExist(err), "the socket should be removed")
+}
+
+func TestStartSSHAgent_Disabled(t *testing.T) {
+	setTestEnv(t, map[string]string{
+		"PLUGIN_SSH_AGENT": "",
+		"DRONE_SSH_KEY":    testSSHKey(t, "ed25519", ""),
+	})
+
+	a, err := startSSHAgent()
+	require.NoError(t, err)
+	assert.Nil(t, a)
+	a.Stop()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHKey is a decrypted private key in the OpenSSH format
+type SSHKey struct {
+	Type        string // rsa, ecdsa or ed25519
+	Fingerprint string
+	PublicKey   ssh.PublicKey
+	PEM         []byte
+}
+
+// Filename returns the default file name of ssh for the key type
+func (k *SSHKey) Filename() string {
+	return "id_" + k.Type
+}
+
+// normalizeSSHKey repairs the formatting damage keys commonly suffer when
+// passed through environment variables and secret stores: surrounding
+// quotes and whitespace, escaped newlines and CRLF line endings
+func normalizeSSHKey(raw string) []byte {
+	key := strings.TrimSpace(raw)
+	if len(key) >= 2 && (key[0] == '"' || key[0] == '\'') && key[len(key)-1] == key[0] {
+		key = strings.TrimSpace(key[1 : len(key)-1])
+	}
+	if !strings.Contains(key, "\n") {
+		key = strings.ReplaceAll(key, `\r\n`, "\n")
+		key = strings.ReplaceAll(key, `\n`, "\n")
+	}
+	key = strings.ReplaceAll(key, "\r\n", "\n")
+	return []byte(key + "\n")
+}
+
+// parseSSHKey parses a PEM or OpenSSH private key, decrypting it in-process
+// with passphrase when it is encrypted. The key is returned re-encoded in
+// the OpenSSH format without encryption.
+func parseSSHKey(raw, passphrase string) (*SSHKey, error) {
+	data := normalizeSSHKey(raw)
+	if block, _ := pem.Decode(data); block == nil {
+		return nil, fmt.Errorf("not a PEM encoded private key")
+	}
+
+	key, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("the key is encrypted but no passphrase is set")
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, []byte(passphrase))
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, fmt.Errorf("incorrect passphrase")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keyType string
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		keyType = "rsa"
+	case *ecdsa.PrivateKey:
+		keyType = "ecdsa"
+	case ed25519.PrivateKey, *ed25519.PrivateKey:
+		keyType = "ed25519"
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &SSHKey{
+		Type:        keyType,
+		Fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+		PublicKey:   signer.PublicKey(),
+		PEM:         pem.EncodeToMemory(block),
+	}, nil
+}
+
+// parseSSHCertificate parses an SSH user certificate in the authorized keys
+// format and checks that it certifies key, is valid at now, lists at least
+// one principal and, when principal is set, is valid for that principal
+func parseSSHCertificate(raw string, key *SSHKey, principal string, now time.Time) (*ssh.Certificate, error) {
+	data := bytes.TrimSpace(normalizeSSHKey(raw))
+	public, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := public.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is a public key, not a certificate", public.Type())
+	}
+
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("not a user certificate")
+	}
+	if !bytes.Equal(cert.Key.Marshal(), key.PublicKey.Marshal()) {
+		return nil, fmt.Errorf("the certificate is for key %s, not %s",
+			ssh.FingerprintSHA256(cert.Key), key.Fingerprint)
+	}
+
+	unix := uint64(now.Unix())
+	if unix < cert.ValidAfter {
+		return nil, fmt.Errorf("the certificate is not valid before %s",
+			time.Unix(int64(cert.ValidAfter), 0).UTC().Format(time.RFC3339))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return nil, fmt.Errorf("the certificate expired at %s",
+			time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339))
+	}
+
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, fmt.Errorf("the certificate has no principals")
+	}
+	if principal != "" {
+		found := false
+		for _, p := range cert.ValidPrincipals {
+			found = found || p == principal
+		}
+		if !found {
+			return nil, fmt.Errorf("the certificate is not valid for principal %s, only for %s",
+				principal, strings.Join(cert.ValidPrincipals, ", "))
+		}
+	}
+	return cert, nil
+}
+
+// certificateExpiry describes when the certificate expires
+func certificateExpiry(cert *ssh.Certificate) string {
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return "never expires"
+	}
+	return "expires at " + time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339)
+}
+
+// configureSSHKey validates DRONE_SSH_KEY before any git command runs. The
+// clone scripts get the decrypted key and the file name for its type, so the
+// passphrase never has to be passed to ssh-keygen. The certificate of
+// PLUGIN_SSH_CERTIFICATE is validated against the key, for the principal of
+// PLUGIN_SSH_CERTIFICATE_PRINCIPAL when set.
+func configureSSHKey() error {
+	raw := os.Getenv("DRONE_SSH_KEY")
+	if raw == "" {
+		return nil
+	}
+
+	key, err := parseSSHKey(raw, os.Getenv("DRONE_SSH_PASSPHRASE"))
+	if err != nil {
+		return fmt.Errorf("invalid DRONE_SSH_KEY: %v", err)
+	}
+	fmt.Printf("[INFO] using %s SSH key %s\n", key.Type, key.Fingerprint)
+
+	os.Setenv("DRONE_SSH_KEY", string(key.PEM))
+	os.Setenv("DRONE_SSH_KEY_NAME", key.Filename())
+	os.Unsetenv("DRONE_SSH_PASSPHRASE")
+
+	if certificate := os.Getenv("PLUGIN_SSH_CERTIFICATE"); certificate != "" {
+		cert, err := parseSSHCertificate(certificate, key, os.Getenv("PLUGIN_SSH_CERTIFICATE_PRINCIPAL"), time.Now())
+		if err != nil {
+			return fmt.Errorf("invalid PLUGIN_SSH_CERTIFICATE: %v", err)
+		}
+		fmt.Printf("[INFO] using SSH certificate %s (serial %d), %s\n", cert.KeyId, cert.Serial, certificateExpiry(cert))
+		os.Setenv("PLUGIN_SSH_CERTIFICATE", string(ssh.MarshalAuthorizedKey(cert)))
+	}
+	return nil
+}
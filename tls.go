@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// tlsCABundle holds the certificates of PLUGIN_SSL_CA_BUNDLE once
+// configureTLS ran, for the HTTP requests of drone-git itself
+var tlsCABundle []byte
+
+// configureTLS trusts the CA bundle of PLUGIN_SSL_CA_BUNDLE and presents the
+// client certificate of PLUGIN_SSL_CLIENT_CERT and PLUGIN_SSL_CLIENT_KEY to
+// the host of the remote. Each setting holds PEM content or a file path. An
+// encrypted key stays encrypted: git asks the drone-git credential helper for
+// PLUGIN_SSL_CLIENT_KEY_PASSPHRASE through http.sslCertPasswordProtected. The
+// settings are scoped to the remote host with http.<url>.sslCAInfo, sslCert
+// and sslKey and passed to every git process through GIT_CONFIG_COUNT, which
+// covers submodules and LFS.
+func configureTLS() error {
+	caBundle := os.Getenv("PLUGIN_SSL_CA_BUNDLE")
+	clientCert := os.Getenv("PLUGIN_SSL_CLIENT_CERT")
+	clientKey := os.Getenv("PLUGIN_SSL_CLIENT_KEY")
+	if caBundle == "" && clientCert == "" && clientKey == "" {
+		return nil
+	}
+	if (clientCert == "") != (clientKey == "") {
+		return fmt.Errorf("PLUGIN_SSL_CLIENT_CERT and PLUGIN_SSL_CLIENT_KEY must be set together")
+	}
+
+	base := tlsBaseURL(os.Getenv("DRONE_REMOTE_URL"))
+	if base == "" {
+		return fmt.Errorf("cannot determine the host of the remote %s for the TLS settings", maskURL(os.Getenv("DRONE_REMOTE_URL")))
+	}
+	dir := filepath.Join(globalTmpDir, "tls")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+
+	if caBundle != "" {
+		data, path, err := readPEMSetting(caBundle)
+		if err != nil {
+			return fmt.Errorf("invalid PLUGIN_SSL_CA_BUNDLE: %v", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(data) {
+			return fmt.Errorf("invalid PLUGIN_SSL_CA_BUNDLE: no certificates found")
+		}
+		if path == "" {
+			if path, err = writeTLSFile(dir, "ca.pem", data); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("[INFO] trusting the CA bundle %s for %s\n", path, base)
+		addGitConfigEnv("http."+base+".sslCAInfo", path)
+		tlsCABundle = data
+	}
+
+	if clientCert != "" {
+		certData, certPath, err := readPEMSetting(clientCert)
+		if err != nil {
+			return fmt.Errorf("invalid PLUGIN_SSL_CLIENT_CERT: %v", err)
+		}
+		keyData, keyPath, err := readPEMSetting(clientKey)
+		if err != nil {
+			return fmt.Errorf("invalid PLUGIN_SSL_CLIENT_KEY: %v", err)
+		}
+		encrypted, err := isEncryptedPEMKey(keyData)
+		if err != nil {
+			return fmt.Errorf("invalid PLUGIN_SSL_CLIENT_KEY: %v", err)
+		}
+
+		// The key of an encrypted pair can only be checked by git
+		var leaf *x509.Certificate
+		if encrypted {
+			if os.Getenv("PLUGIN_SSL_CLIENT_KEY_PASSPHRASE") == "" {
+				return fmt.Errorf("invalid PLUGIN_SSL_CLIENT_KEY: the key is encrypted but PLUGIN_SSL_CLIENT_KEY_PASSPHRASE is not set")
+			}
+			block, _ := pem.Decode(certData)
+			if block == nil {
+				return fmt.Errorf("invalid client certificate: no certificate found")
+			}
+			if leaf, err = x509.ParseCertificate(block.Bytes); err != nil {
+				return fmt.Errorf("invalid client certificate: %v", err)
+			}
+		} else {
+			pair, err := tls.X509KeyPair(certData, keyData)
+			if err != nil {
+				return fmt.Errorf("invalid client certificate: %v", err)
+			}
+			leaf, _ = x509.ParseCertificate(pair.Certificate[0])
+		}
+		if leaf != nil {
+			fmt.Printf("[INFO] presenting the client certificate %s to %s, expires at %s\n",
+				leaf.Subject, base, leaf.NotAfter.UTC().Format("2006-01-02T15:04:05Z"))
+		}
+
+		if certPath == "" {
+			if certPath, err = writeTLSFile(dir, "client.pem", certData); err != nil {
+				return err
+			}
+		}
+		if keyPath == "" {
+			if keyPath, err = writeTLSFile(dir, "client.key", keyData); err != nil {
+				return err
+			}
+		}
+		addGitConfigEnv("http."+base+".sslCert", certPath)
+		addGitConfigEnv("http."+base+".sslKey", keyPath)
+
+		if encrypted {
+			exe, err := os.Executable()
+			if err != nil {
+				return fmt.Errorf("failed to locate drone-git for the key passphrase: %v", err)
+			}
+			addGitConfigEnv("http."+base+".sslCertPasswordProtected", "true")
+			addGitConfigEnv("credential.helper", fmt.Sprintf("!\"%s\" credential cert", exe))
+		}
+	}
+
+	// Schannel, the default on windows, ignores the CA bundle and the client
+	// certificate files
+	if runtime.GOOS == "windows" {
+		addGitConfigEnv("http.sslBackend", "openssl")
+	}
+	return nil
+}
+
+// remoteHTTPClient returns an HTTP client for requests of drone-git itself
+// to the git host, going through the proxies of the clone and trusting the
+// system roots and the CA bundle of PLUGIN_SSL_CA_BUNDLE
+func remoteHTTPClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = httpProxy
+	if len(tlsCABundle) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pool.AppendCertsFromPEM(tlsCABundle)
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// tlsBaseURL returns the https URL of the remote host the TLS settings are
+// scoped to. SSH remotes get the https URL of their host for LFS.
+func tlsBaseURL(remote string) string {
+	if u, err := url.Parse(remote); err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" {
+		return "https://" + u.Host + "/"
+	}
+	if host := os.Getenv("DRONE_NETRC_MACHINE"); host != "" {
+		return "https://" + host + "/"
+	}
+	if host := remoteHost(remote); host != "" {
+		return "https://" + host + "/"
+	}
+	return ""
+}
+
+// readPEMSetting returns the PEM data of a setting holding either PEM content
+// or the path of a PEM file, and the path when it is a file
+func readPEMSetting(value string) ([]byte, string, error) {
+	if strings.Contains(value, "-----BEGIN ") {
+		return normalizeSSHKey(value), "", nil
+	}
+	data, err := os.ReadFile(value)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %v", value, err)
+	}
+	return data, value, nil
+}
+
+// writeTLSFile writes data to a file readable only by the current user
+func writeTLSFile(dir, name string, data []byte) (string, error) {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return path, nil
+}
+
+// isEncryptedPEMKey reports whether a PEM private key is an encrypted PKCS#8
+// key or a legacy OpenSSL key with a Proc-Type encryption header
+func isEncryptedPEMKey(data []byte) (bool, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false, fmt.Errorf("not a PEM encoded private key")
+	}
+	return block.Type == "ENCRYPTED PRIVATE KEY" || strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED"), nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClientCertificate returns a self-signed PEM certificate and its PKCS#8 key
+func testClientCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ci"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+// gitConfigEnv returns the GIT_CONFIG_COUNT entries as key=value
+func gitConfigEnv(t *testing.T) map[string]string {
+	t.Helper()
+
+	entries := map[string]string{}
+	var count int
+	fmt.Sscan(os.Getenv("GIT_CONFIG_COUNT"), &count)
+	for i := 0; i < count; i++ {
+		entries[os.Getenv(fmt.Sprintf("GIT_CONFIG_KEY_%d", i))] = os.Getenv(fmt.Sprintf("GIT_CONFIG_VALUE_%d", i))
+	}
+	return entries
+}
+
+func setTLSTestEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+
+	previous, previousBundle := globalTmpDir, tlsCABundle
+	globalTmpDir = t.TempDir()
+	t.Cleanup(func() { globalTmpDir, tlsCABundle = previous, previousBundle })
+
+	base := map[string]string{
+		"DRONE_REMOTE_URL":                 "https://git.example.com:8443/org/repo.git",
+		"DRONE_NETRC_MACHINE":              "",
+		"PLUGIN_SSL_CA_BUNDLE":             "",
+		"PLUGIN_SSL_CLIENT_CERT":           "",
+		"PLUGIN_SSL_CLIENT_KEY":            "",
+		"PLUGIN_SSL_CLIENT_KEY_PASSPHRASE": "",
+		"GIT_CONFIG_COUNT":                 "",
+	}
+	// t.Setenv restores the entries added by configureTLS
+	for i := 0; i < 6; i++ {
+		base[fmt.Sprintf("GIT_CONFIG_KEY_%d", i)] = ""
+		base[fmt.Sprintf("GIT_CONFIG_VALUE_%d", i)] = ""
+	}
+	for k, v := range env {
+		base[k] = v
+	}
+	setTestEnv(t, base)
+}
+
+func TestConfigureTLS(t *testing.T) {
+	cert, key := testClientCertificate(t)
+	keyFile := filepath.Join(t.TempDir(), "client.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(key), 0600))
+
+	setTLSTestEnv(t, map[string]string{
+		"PLUGIN_SSL_CA_BUNDLE":   cert,
+		"PLUGIN_SSL_CLIENT_CERT": cert,
+		"PLUGIN_SSL_CLIENT_KEY":  keyFile,
+	})
+	require.NoError(t, configureTLS())
+
+	config := gitConfigEnv(t)
+	caPath := config["http.https://git.example.com:8443/.sslCAInfo"]
+	certPath := config["http.https://git.example.com:8443/.sslCert"]
+	assert.Equal(t, filepath.Join(globalTmpDir, "tls", "ca.pem"), caPath)
+	assert.Equal(t, filepath.Join(globalTmpDir, "tls", "client.pem"), certPath)
+	// a key file is used in place
+	assert.Equal(t, keyFile, config["http.https://git.example.com:8443/.sslKey"])
+
+	data, err := os.ReadFile(caPath)
+	require.NoError(t, err)
+	assert.Equal(t, cert, string(data))
+	info, err := os.Stat(certPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestConfigureTLS_SSHRemote(t *testing.T) {
+	cert, _ := testClientCertificate(t)
+	setTLSTestEnv(t, map[string]string{
+		"DRONE_REMOTE_URL":     "git@git.example.com:org/repo.git",
+		"PLUGIN_SSL_CA_BUNDLE": cert,
+	})
+	require.NoError(t, configureTLS())
+
+	// LFS of an ssh remote goes through https on the same host
+	assert.Contains(t, gitConfigEnv(t), "http.https://git.example.com/.sslCAInfo")
+}
+
+func TestConfigureTLS_Invalid(t *testing.T) {
+	cert, key := testClientCertificate(t)
+	_, otherKey := testClientCertificate(t)
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		err  string
+	}{
+		{
+			name: "cert without key",
+			env:  map[string]string{"PLUGIN_SSL_CLIENT_CERT": cert},
+			err:  "must be set together",
+		},
+		{
+			name: "missing file",
+			env:  map[string]string{"PLUGIN_SSL_CA_BUNDLE": "/does/not/exist.pem"},
+			err:  "invalid PLUGIN_SSL_CA_BUNDLE: failed to read",
+		},
+		{
+			name: "bundle without certificates",
+			env:  map[string]string{"PLUGIN_SSL_CA_BUNDLE": key},
+			err:  "no certificates found",
+		},
+		{
+			name: "mismatched key",
+			env:  map[string]string{"PLUGIN_SSL_CLIENT_CERT": cert, "PLUGIN_SSL_CLIENT_KEY": otherKey},
+			err:  "invalid client certificate",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setTLSTestEnv(t, test.env)
+			err := configureTLS()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.err)
+		})
+	}
+}
+
+// encryptTestKey encrypts a PEM key with openssl as PKCS#8 with passphrase
+func encryptTestKey(t *testing.T, key, passphrase string) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl is not installed")
+	}
+	keyFile := filepath.Join(t.TempDir(), "client.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(key), 0600))
+	out, err := exec.Command("openssl", "pkcs8", "-topk8", "-v2", "aes-256-cbc",
+		"-in", keyFile, "-passout", "pass:"+passphrase).CombinedOutput()
+	require.NoError(t, err, string(out))
+	return string(out)
+}
+
+func TestConfigureTLS_EncryptedKey(t *testing.T) {
+	cert, key := testClientCertificate(t)
+	encrypted := encryptTestKey(t, key, "secret")
+
+	setTLSTestEnv(t, map[string]string{
+		"PLUGIN_SSL_CLIENT_CERT": cert,
+		"PLUGIN_SSL_CLIENT_KEY":  encrypted,
+	})
+	assert.EqualError(t, configureTLS(), "invalid PLUGIN_SSL_CLIENT_KEY: the key is encrypted but PLUGIN_SSL_CLIENT_KEY_PASSPHRASE is not set")
+
+	setTLSTestEnv(t, map[string]string{
+		"PLUGIN_SSL_CLIENT_CERT":           cert,
+		"PLUGIN_SSL_CLIENT_KEY":            encrypted,
+		"PLUGIN_SSL_CLIENT_KEY_PASSPHRASE": "secret",
+	})
+	require.NoError(t, configureTLS())
+
+	// The key is written as it is and git asks drone-git for the passphrase
+	config := gitConfigEnv(t)
+	data, err := os.ReadFile(config["http.https://git.example.com:8443/.sslKey"])
+	require.NoError(t, err)
+	assert.Equal(t, encrypted, string(data))
+	assert.Equal(t, "true", config["http.https://git.example.com:8443/.sslCertPasswordProtected"])
+	assert.Contains(t, config["credential.helper"], "\" credential cert")
+}
+
+func TestConfigureTLS_EncryptedKeyClone(t *testing.T) {
+	cert, key := testClientCertificate(t)
+	encrypted := encryptTestKey(t, key, "secret")
+
+	// A server requiring the client certificate
+	var mu sync.Mutex
+	var subjects []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		for _, peer := range r.TLS.PeerCertificates {
+			subjects = append(subjects, peer.Subject.CommonName)
+		}
+		mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	serverCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	setTLSTestEnv(t, map[string]string{
+		"DRONE_REMOTE_URL":                 server.URL + "/org/repo.git",
+		"PLUGIN_SSL_CA_BUNDLE":             string(serverCert),
+		"PLUGIN_SSL_CLIENT_CERT":           cert,
+		"PLUGIN_SSL_CLIENT_KEY":            encrypted,
+		"PLUGIN_SSL_CLIENT_KEY_PASSPHRASE": "secret",
+		"GIT_TERMINAL_PROMPT":              "0",
+	})
+	require.NoError(t, configureTLS())
+
+	// GIT_SSL_CAINFO would take precedence over the CA bundle
+	t.Setenv("GIT_SSL_CAINFO", "")
+	os.Unsetenv("GIT_SSL_CAINFO")
+
+	out, err := exec.Command("git", "ls-remote", server.URL+"/org/repo.git").CombinedOutput()
+	require.Error(t, err, "the server has no repository")
+	assert.Contains(t, string(out), "not found", string(out))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Contains(t, subjects, "ci")
+}
+
+func TestCertCredentialHelper(t *testing.T) {
+	t.Setenv("PLUGIN_SSL_CLIENT_KEY_PASSPHRASE", "secret")
+
+	var stdout bytes.Buffer
+	require.NoError(t, runCredentialHelper([]string{"cert", "get"}, strings.NewReader("protocol=cert\npath=/tls/client.pem\n\n"), &stdout))
+	assert.Equal(t, "password=secret\n", stdout.String())
+
+	// The clone credentials are not served
+	stdout.Reset()
+	require.NoError(t, runCredentialHelper([]string{"cert", "get"}, strings.NewReader("protocol=https\nhost=github.com\n\n"), &stdout))
+	assert.Empty(t, stdout.String())
+}
+
+func TestRemoteHTTPClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	setTLSTestEnv(t, nil)
+	_, err := remoteHTTPClient(time.Second).Get(server.URL)
+	assert.Error(t, err)
+
+	tlsCABundle = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	resp, err := remoteHTTPClient(time.Second).Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// The requests go through the proxy of the clone
+	proxy, tunnels := startTestProxy(t, "http")
+	setTestEnv(t, map[string]string{
+		"HARNESS_GIT_PROXY":   "true",
+		"HARNESS_HTTPS_PROXY": proxy,
+		"PLUGIN_PROXIES":      "",
+		"NO_PROXY":            "",
+		"no_proxy":            "",
+	})
+	resp, err = remoteHTTPClient(time.Second).Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(tunnels))
+}
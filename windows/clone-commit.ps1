@@ -13,9 +13,16 @@ if ($Env:PLUGIN_DEPTH) {
 # such as github deployment events. If the branch
 # is empty we checkout the sha directly. Note that
 # we intentially omit depth flags to avoid failed
-# clones due to lack of history.
+# clones due to lack of history. Additional
+# repositories checked out at a commit fetch only
+# that commit with their depth.
 if ([string]::IsNullOrEmpty($env:DRONE_COMMIT_BRANCH)) {
-	sf -flags $null -ref $null
+	if ($FLAGS -and $Env:DRONE_GIT_ADDITIONAL_REPOSITORY -eq "true") {
+		sf -flags ${FLAGS} -ref ${Env:DRONE_COMMIT_SHA}
+	} else {
+		sf -flags $null -ref $null
+	}
+	Set-SparseCheckout -rev ${Env:DRONE_COMMIT_SHA}
 	Write-Host "+ git checkout -qf ${Env:DRONE_COMMIT_SHA}";
 	iu git checkout -qf ${Env:DRONE_COMMIT_SHA}
 	exit 0
@@ -26,10 +33,12 @@ if ([string]::IsNullOrEmpty($env:DRONE_COMMIT_BRANCH)) {
 # the commit is empty we clone the branch.
 if ([string]::IsNullOrEmpty($env:DRONE_COMMIT_SHA)) {
 	sf -flags ${FLAGS} -ref "+refs/heads/${Env:DRONE_COMMIT_BRANCH}"
+	Set-SparseCheckout -rev FETCH_HEAD
 	Write-Host "+ git checkout -B ${Env:DRONE_COMMIT_BRANCH} origin/${Env:DRONE_COMMIT_BRANCH}";
 	iu git checkout -B ${Env:DRONE_COMMIT_BRANCH} origin/${Env:DRONE_COMMIT_BRANCH}
 }else{
 	sf -flags ${FLAGS} -ref "+refs/heads/${Env:DRONE_COMMIT_BRANCH}"
+	Set-SparseCheckout -rev ${Env:DRONE_COMMIT_SHA}
 	Write-Host "+ git checkout ${Env:DRONE_COMMIT_SHA} -B ${Env:DRONE_COMMIT_BRANCH}"
 	iu git checkout ${Env:DRONE_COMMIT_SHA} -B ${Env:DRONE_COMMIT_BRANCH}
 }
\ No newline at end of file
@@ -11,12 +11,14 @@ if ($Env:PLUGIN_DEPTH) {
 
 if ($Env:PLUGIN_PR_CLONE_STRATEGY -eq "SourceBranch") {
 	sf -flags ${FLAGS} -ref "${Env:DRONE_COMMIT_REF}"
+	Set-SparseCheckout -rev ${Env:DRONE_COMMIT_SHA}
 	Write-Host "+ git checkout ${Env:DRONE_COMMIT_SHA} -B ${Env:DRONE_SOURCE_BRANCH}"
 	iu git checkout ${Env:DRONE_COMMIT_SHA} -B ${Env:DRONE_SOURCE_BRANCH}
 	exit 0
 }
 
 sf -flags ${FLAGS} -ref "+refs/heads/${Env:DRONE_COMMIT_BRANCH}"
+Set-SparseCheckout -rev FETCH_HEAD
 
 if (Test-Path env:DRONE_COMMIT_BEFORE) {
 	if ($env:DRONE_PR_MERGE_STRATEGY_BRANCH -eq "true") {
@@ -10,5 +10,6 @@ if ($Env:PLUGIN_DEPTH) {
 }
 
 sf -flags ${FLAGS} -ref "+refs/tags/${Env:DRONE_TAG}"
+Set-SparseCheckout -rev FETCH_HEAD
 Write-Host "+ git checkout -qf ${Env:FETCH_HEAD}";
 iu git checkout -qf FETCH_HEAD
@@ -27,8 +27,33 @@ if ($Env:HARNESS_GIT_CONFIG_FOLDER) {
 }
 
 # if the netrc enviornment variables exist, write
-# the netrc file.
-if ($Env:DRONE_NETRC_MACHINE) {
+# the netrc file. With PLUGIN_CREDENTIAL_HELPER the credentials are served
+# by drone-git as a git credential helper instead and never written to disk.
+# The helper is configured through GIT_CONFIG_COUNT so that it only applies
+# to the git processes of this step. The hosts of the PLUGIN_CREDENTIALS
+# list are served by drone-git in both cases.
+$credentialsList = ($Env:PLUGIN_CREDENTIALS -or $Env:PLUGIN_CREDENTIALS_FILE) -and $Env:DRONE_GIT_BIN
+$credentialHelper = ($Env:DRONE_NETRC_MACHINE -or $credentialsList) -and $Env:PLUGIN_CREDENTIAL_HELPER -eq "true" -and $Env:DRONE_GIT_BIN
+if ($credentialHelper) {
+    Write-Host "[INFO] serving credentials through the drone-git credential helper"
+    $count = 0
+    if ($Env:GIT_CONFIG_COUNT) {
+        $count = [int]$Env:GIT_CONFIG_COUNT
+    }
+    # the helper runs through the shell of git, which needs forward slashes
+    $helper = $Env:DRONE_GIT_BIN -replace "\\", "/"
+    Set-Item -Path "env:GIT_CONFIG_KEY_$count" -Value "credential.helper"
+    Set-Item -Path "env:GIT_CONFIG_VALUE_$count" -Value "!`"$helper`" credential"
+    Set-Item -Path "env:GIT_CONFIG_KEY_$($count + 1)" -Value "credential.useHttpPath"
+    Set-Item -Path "env:GIT_CONFIG_VALUE_$($count + 1)" -Value "true"
+    $Env:GIT_CONFIG_COUNT = $count + 2
+    $Env:GIT_TERMINAL_PROMPT = "0"
+    Remove-Item -Force -ErrorAction SilentlyContinue (Join-Path $Env:USERPROFILE '_netrc')
+} elseif ($credentialsList) {
+    $netrc = & $Env:DRONE_GIT_BIN credential netrc
+    if ($LASTEXITCODE) { Throw "drone-git credential netrc failed (exit code $LASTEXITCODE)." }
+    ($netrc -join "`n") + "`n" | Out-File -FilePath (Join-Path $Env:USERPROFILE '_netrc') -Encoding ascii -NoNewline
+} elseif ($Env:DRONE_NETRC_MACHINE) {
 @"
 machine $Env:DRONE_NETRC_MACHINE
 login $Env:DRONE_NETRC_USERNAME
@@ -40,7 +65,7 @@ password $Env:DRONE_NETRC_PASSWORD
 
 # Windows-specific: Persist Git credentials by mounting _netrc from the shared path
 # so that subsequent steps in the pipeline can use them for authenticated Git operations.
-if ($Env:DRONE_PERSIST_CREDS) {
+if ($Env:DRONE_PERSIST_CREDS -and -not $credentialHelper) {
         $sourcePath = Join-Path $Env:USERPROFILE '_netrc';
     $destinationPath = 'C:\addon\shared\_netrc';
     New-Item -ItemType Directory -Path (Split-Path $destinationPath) -Force;
@@ -50,17 +75,53 @@ if ($Env:DRONE_PERSIST_CREDS) {
 }
 
 if ($Env:DRONE_SSH_KEY) {
+    # drone-git validates and decrypts the key and names the file after the
+    # key type; id_rsa is kept when the script runs on its own.
+    $SSH_KEY_NAME = "id_rsa"
+    if ($Env:DRONE_SSH_KEY_NAME) {
+        $SSH_KEY_NAME = $Env:DRONE_SSH_KEY_NAME
+    }
     if ($Env:HARNESS_GIT_CONFIG_FOLDER) {
         $SSH_DIR = Join-Path $Env:USERPROFILE ".ssh"
-        $SSH_KEY_PATH = Join-Path $SSH_DIR "id_rsa"
-        mkdir $SSH_DIR -Force
-        echo $Env:DRONE_SSH_KEY > $SSH_KEY_PATH
-        $Env:GIT_SSH_COMMAND="ssh -i $SSH_KEY_PATH ${Env:SSH_KEYSCAN_FLAGS} -o StrictHostKeyChecking=no"
     } else {
-        mkdir C:\.ssh  -Force
-        echo $Env:DRONE_SSH_KEY > C:\.ssh\id_rsa
-        $Env:GIT_SSH_COMMAND="ssh -i C:/.ssh/id_rsa ${Env:SSH_KEYSCAN_FLAGS} -o StrictHostKeyChecking=no"
+        $SSH_DIR = "C:\.ssh"
+    }
+    $SSH_KEY_PATH = Join-Path $SSH_DIR $SSH_KEY_NAME
+    mkdir $SSH_DIR -Force
+    echo $Env:DRONE_SSH_KEY > $SSH_KEY_PATH
+
+    # the user certificate of PLUGIN_SSH_CERTIFICATE, validated by drone-git,
+    # is written next to the key as ssh expects it
+    $SSH_CERT_OPTIONS = ""
+    if ($Env:PLUGIN_SSH_CERTIFICATE) {
+        $SSH_CERT_PATH = "$SSH_KEY_PATH-cert.pub"
+        $Env:PLUGIN_SSH_CERTIFICATE | Out-File -FilePath $SSH_CERT_PATH -Encoding ascii
+        $SSH_CERT_OPTIONS = "-o CertificateFile=$($SSH_CERT_PATH -replace '\\', '/')"
+    }
+
+    # the host keys pinned with PLUGIN_SSH_KNOWN_HOSTS or
+    # PLUGIN_SSH_HOST_KEY_FINGERPRINTS, verified by drone-git, or scanned by
+    # drone-git through the SSH proxy are the only trusted keys. Without pins
+    # any host key is accepted unless PLUGIN_SSH_STRICT_HOST_KEY_CHECKING is
+    # set, never behind the proxy.
+    # ssh connects through the proxy of PLUGIN_SSH_PROXY with drone-git as
+    # the ProxyCommand; NO_PROXY hosts are connected to directly
+    $SSH_PROXY_OPTIONS = ""
+    if ($Env:DRONE_SSH_PROXY -and $Env:DRONE_GIT_BIN) {
+        $SSH_PROXY_OPTIONS = "-o `"ProxyCommand=$($Env:DRONE_GIT_BIN -replace '\\', '/') ssh-proxy %h %p`""
+    }
+
+    $SSH_HOST_KEY_OPTIONS = "-o StrictHostKeyChecking=no"
+    if ($Env:DRONE_SSH_KNOWN_HOSTS) {
+        $KNOWN_HOSTS_PATH = Join-Path $SSH_DIR "known_hosts"
+        $Env:DRONE_SSH_KNOWN_HOSTS | Out-File -FilePath $KNOWN_HOSTS_PATH -Encoding ascii
+        $SSH_HOST_KEY_OPTIONS = "-o StrictHostKeyChecking=yes -o UserKnownHostsFile=$($KNOWN_HOSTS_PATH -replace '\\', '/')"
+    } elseif ($SSH_PROXY_OPTIONS) {
+        Throw "the host keys of $Env:DRONE_NETRC_MACHINE were not scanned through the SSH proxy"
+    } elseif ($Env:PLUGIN_SSH_STRICT_HOST_KEY_CHECKING -eq "true") {
+        Throw "PLUGIN_SSH_STRICT_HOST_KEY_CHECKING requires PLUGIN_SSH_KNOWN_HOSTS or PLUGIN_SSH_HOST_KEY_FINGERPRINTS"
     }
+    $Env:GIT_SSH_COMMAND="ssh -i $($SSH_KEY_PATH -replace '\\', '/') $SSH_CERT_OPTIONS ${Env:SSH_KEYSCAN_FLAGS} $SSH_HOST_KEY_OPTIONS $SSH_PROXY_OPTIONS"
 }
 
 # configure git global behavior and parameters via the
@@ -114,6 +175,16 @@ switch -regex ($Env:DRONE_COMMIT_REF)
 
 }
 
+# with PLUGIN_LFS_SKIP_SMUDGE the checkout of the repository leaves pointer
+# files and its LFS objects are downloaded by a single git lfs pull
+# afterwards, with parallel transfers. Smudging is only skipped for that
+# checkout, the worktree and the submodules download their LFS objects
+# when they are checked out.
+$lfsPull = $Env:DRONE_NETRC_LFS_ENABLED -eq "true" -and $Env:PLUGIN_LFS_SKIP_SMUDGE -eq "true"
+if ($lfsPull) {
+    $Env:GIT_LFS_SKIP_SMUDGE = "1"
+}
+
 Invoke-Expression "${PSScriptRoot}\common.ps1"
 
 switch ($CLONE_TYPE) {
@@ -131,4 +202,22 @@ switch ($CLONE_TYPE) {
     }
 }
 
+if ($lfsPull) {
+    Remove-Item Env:GIT_LFS_SKIP_SMUDGE
+    Write-Host "+ git lfs pull"
+    git lfs pull
+    if ($LASTEXITCODE) { Throw "git lfs pull failed (exit code $LASTEXITCODE)." }
+}
+
+if ($CLONE_TYPE -eq "pull_request") {
+    Invoke-Expression "${PSScriptRoot}\worktree.ps1"
+}
+
 Invoke-Expression "${PSScriptRoot}\post-fetch.ps1"
+
+# inspect the checked out repository when running under the
+# drone-git binary (changed files, path filters, ...).
+if ($Env:DRONE_GIT_BIN) {
+    & $Env:DRONE_GIT_BIN post-clone
+    if ($LASTEXITCODE) { Throw "drone-git post-clone failed (exit code $LASTEXITCODE)." }
+}
@@ -53,15 +53,69 @@ if (!(Test-Path .git)) {
     Set-OriginUrl -originUrl $Env:DRONE_REMOTE_URL
 }
 
+# the rules written by a previous build in a persisted workspace or global
+# config are recorded under drone-git.urlRewrite and removed, so that a rule
+# dropped from the list does not stay behind. Rewrites configured by other
+# means are kept.
+foreach ($rule in @(git config $GIT_CONFIG_SCOPE --get-all drone-git.urlRewrite)) {
+    $prefix, $replacement = $rule -split "=", 2
+    git config $GIT_CONFIG_SCOPE --fixed-value --unset-all "url.$replacement.insteadOf" $prefix
+}
+git config $GIT_CONFIG_SCOPE --unset-all drone-git.urlRewrite
+
+# rewrite URLs of every remote (origin, submodules, LFS endpoints) with the
+# prefix=replacement rules of PLUGIN_URL_REWRITES, e.g. to go through an
+# internal mirror. Credentials are masked in the log.
+if ($env:PLUGIN_URL_REWRITES) {
+    $rules = $env:PLUGIN_URL_REWRITES -split "[,`n]" | ForEach-Object { $_.Trim() } | Where-Object { $_ -ne "" }
+
+    foreach ($rule in $rules) {
+        $prefix, $replacement = $rule -split "=", 2
+        if ($null -eq $replacement) {
+            Throw "invalid URL rewrite $(Get-MaskedUrl $rule), expected prefix=replacement"
+        }
+    }
+
+    foreach ($rule in $rules) {
+        $prefix, $replacement = $rule -split "=", 2
+        Write-Host "[INFO] rewriting URLs starting with $(Get-MaskedUrl $prefix) to $(Get-MaskedUrl $replacement)"
+        iu git config $GIT_CONFIG_SCOPE --add "url.$replacement.insteadOf" $prefix
+        iu git config $GIT_CONFIG_SCOPE --add drone-git.urlRewrite $rule
+    }
+
+    Write-Host "[INFO] effective origin URL: $(Get-MaskedUrl (git remote get-url origin))"
+}
+
 if ($env:DRONE_NETRC_LFS_ENABLED -eq "true") {
     Write-Host "+ git lfs install"
     iu git lfs install
+
+    # restrict the LFS objects to download by path and set the number of
+    # parallel transfers. The settings are local to the repository and reset
+    # when unset so that a persisted workspace follows the current build.
+    $lfsSettings = [ordered]@{
+        "lfs.fetchinclude"        = $env:PLUGIN_LFS_INCLUDE
+        "lfs.fetchexclude"        = $env:PLUGIN_LFS_EXCLUDE
+        "lfs.concurrenttransfers" = $env:PLUGIN_LFS_CONCURRENCY
+    }
+    foreach ($setting in $lfsSettings.GetEnumerator()) {
+        if ($setting.Value) {
+            Write-Host "+ git config --local $($setting.Key) $($setting.Value)"
+            iu git config --local $setting.Key $setting.Value
+        } else {
+            git config --local --unset-all $setting.Key
+        }
+    }
 }
 
 
-if ($env:HARNESS_GIT_PROXY -eq "true" -and -not [string]::IsNullOrEmpty($env:HARNESS_HTTPS_PROXY)) {
-    Write-Host "+ git config $GIT_CONFIG_SCOPE http.proxy $env:HARNESS_HTTPS_PROXY"
+# drone-git passes the proxy settings to git through GIT_CONFIG_COUNT, the
+# proxy is only written to the git config when the script runs on its own
+if ($env:HARNESS_GIT_PROXY -eq "true" -and -not [string]::IsNullOrEmpty($env:HARNESS_HTTPS_PROXY) -and -not $env:DRONE_GIT_BIN) {
+    Write-Host "+ git config $GIT_CONFIG_SCOPE http.proxy $(Get-MaskedUrl $env:HARNESS_HTTPS_PROXY)"
     iu git config $GIT_CONFIG_SCOPE http.proxy $env:HARNESS_HTTPS_PROXY
+    # recorded so that only this proxy is removed with the credentials
+    iu git config $GIT_CONFIG_SCOPE drone-git.httpProxy $env:HARNESS_HTTPS_PROXY
 }
 
 if ($env:DRONE_NETRC_FETCH_TAGS -eq "true") {
@@ -69,15 +123,7 @@ if ($env:DRONE_NETRC_FETCH_TAGS -eq "true") {
     iu git fetch --tags
 }
 
-if (-not [string]::IsNullOrEmpty($env:DRONE_NETRC_SPARSE_CHECKOUT)) {
-    Write-Host '+ git sparse-checkout init'
-    iu git sparse-checkout init
-    $lines = $env:DRONE_NETRC_SPARSE_CHECKOUT -split "`n"
-    foreach ($line in $lines) {
-        Write-Host "+ git sparse-checkout add $line"
-        iu git sparse-checkout add $line
-    }
-}
+Set-SparseCheckout -rev $null
 
 if (-not [string]::IsNullOrEmpty($env:DRONE_NETRC_PRE_FETCH)) {
     $lines = $env:DRONE_NETRC_PRE_FETCH -split "`n"
@@ -1,3 +1,12 @@
+# Masks the credentials of a URL before it is logged
+function Get-MaskedUrl {
+    param (
+        $url
+    )
+
+    return $url -replace "(://)[^/@]+@", '$1****@'
+}
+
 function Start-Fetch {
     param (
         $flags,
@@ -14,4 +23,69 @@ function Start-Fetch {
         Write-Host "+ git fetch ${flags} origin ${ref}:"
         iu git fetch ${flags} origin "${ref}:"
     }
-}
\ No newline at end of file
+}
+# Applies the sparse checkout patterns with set semantics before anything is
+# checked out, so that files outside of the patterns are never written and,
+# with a partial clone, never downloaded. Patterns are read from
+# DRONE_NETRC_SPARSE_CHECKOUT (one per line), from the file named by
+# PLUGIN_SPARSE_CHECKOUT_FILE and from the file PLUGIN_SPARSE_CHECKOUT_REPO_FILE
+# committed in the repository. The latter can only be read once the commit
+# is fetched, which is why the clone scripts call this again with the
+# fetched revision.
+function Set-SparseCheckout {
+    param (
+        $rev
+    )
+
+    if ([string]::IsNullOrEmpty($env:DRONE_NETRC_SPARSE_CHECKOUT) -and
+        [string]::IsNullOrEmpty($env:PLUGIN_SPARSE_CHECKOUT_FILE) -and
+        [string]::IsNullOrEmpty($env:PLUGIN_SPARSE_CHECKOUT_REPO_FILE)) {
+        return
+    }
+
+    # patterns are applied exactly once: right away, or after the fetch when
+    # they include a file from the repository.
+    if ([string]::IsNullOrEmpty($env:PLUGIN_SPARSE_CHECKOUT_REPO_FILE) -ne [string]::IsNullOrEmpty($rev)) {
+        return
+    }
+
+    $flags = @()
+    switch ($env:PLUGIN_SPARSE_CHECKOUT_MODE) {
+        "" { }
+        $null { }
+        "cone" { $flags += "--cone" }
+        "no-cone" { $flags += "--no-cone" }
+        "non-cone" { $flags += "--no-cone" }
+        default { Throw "unknown sparse checkout mode $env:PLUGIN_SPARSE_CHECKOUT_MODE, expected cone or no-cone" }
+    }
+
+    if ($env:PLUGIN_SPARSE_INDEX -eq "true") {
+        $flags += "--sparse-index"
+    } elseif ($env:PLUGIN_SPARSE_INDEX -eq "false") {
+        $flags += "--no-sparse-index"
+    }
+
+    $patterns = @()
+    if (-not [string]::IsNullOrEmpty($env:DRONE_NETRC_SPARSE_CHECKOUT)) {
+        $patterns += $env:DRONE_NETRC_SPARSE_CHECKOUT -split "`n"
+    }
+    if (-not [string]::IsNullOrEmpty($env:PLUGIN_SPARSE_CHECKOUT_FILE)) {
+        if (!(Test-Path $env:PLUGIN_SPARSE_CHECKOUT_FILE)) {
+            Throw "sparse checkout file $env:PLUGIN_SPARSE_CHECKOUT_FILE does not exist"
+        }
+        $patterns += Get-Content $env:PLUGIN_SPARSE_CHECKOUT_FILE
+    }
+    if (-not [string]::IsNullOrEmpty($rev)) {
+        Write-Host "+ git show ${rev}:$env:PLUGIN_SPARSE_CHECKOUT_REPO_FILE"
+        $content = git show "${rev}:$env:PLUGIN_SPARSE_CHECKOUT_REPO_FILE"
+        if ($LASTEXITCODE) {
+            Throw "sparse checkout file $env:PLUGIN_SPARSE_CHECKOUT_REPO_FILE does not exist in $rev"
+        }
+        $patterns += $content
+    }
+    $patterns = $patterns | ForEach-Object { $_.Trim() } | Where-Object { $_ -ne "" -and -not $_.StartsWith("#") }
+
+    Write-Host "+ git sparse-checkout set $flags --stdin"
+    $patterns | git sparse-checkout set @flags --stdin
+    if ($LASTEXITCODE) { Throw "git sparse-checkout set failed (exit code $LASTEXITCODE)." }
+}
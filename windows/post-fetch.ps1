@@ -1,11 +1,158 @@
-. "${PSScriptRoot}\utility.ps1"
+. "${PSScriptRoot}\git-utility.ps1"
 
-Set-Alias iu Invoke-Utility
+# update the submodules according to DRONE_NETRC_SUBMODULE_STRATEGY (true or
+# recursive). PLUGIN_SUBMODULE_DEPTH, PLUGIN_SUBMODULE_JOBS and
+# PLUGIN_SUBMODULE_REMOTE map to the --depth, --jobs and --remote flags of
+# git submodule update. PLUGIN_SUBMODULE_INCLUDE and PLUGIN_SUBMODULE_EXCLUDE
+# select the top level submodules by path (comma or newline separated,
+# wildcards allowed). A failed update is retried PLUGIN_SUBMODULE_RETRIES
+# times with an exponential backoff.
 
+$flags = @()
 if ($env:DRONE_NETRC_SUBMODULE_STRATEGY -eq "true") {
-    Write-Host '+ git submodule update --init'
-    iu git submodule update --init
+    $flags += "--init"
 } elseif ($env:DRONE_NETRC_SUBMODULE_STRATEGY -eq "recursive") {
-    Write-Host '+ git submodule update --init --recursive'
-    iu git submodule update --init --recursive
-}
\ No newline at end of file
+    $flags += "--init", "--recursive"
+} else {
+    return
+}
+
+if ($env:PLUGIN_SUBMODULE_DEPTH) {
+    $flags += "--depth=$env:PLUGIN_SUBMODULE_DEPTH"
+}
+if ($env:PLUGIN_SUBMODULE_JOBS) {
+    $flags += "--jobs=$env:PLUGIN_SUBMODULE_JOBS"
+}
+if ($env:PLUGIN_SUBMODULE_REMOTE -eq "true") {
+    $flags += "--remote"
+}
+
+function Test-SubmodulePath {
+    param (
+        $path,
+        $patterns
+    )
+
+    foreach ($pattern in $patterns -split "[,`n]") {
+        $pattern = $pattern.Trim().TrimEnd("/")
+        if ($pattern -ne "" -and ($path -like $pattern -or $path -like "$pattern/*")) {
+            return $true
+        }
+    }
+    return $false
+}
+
+$paths = @()
+if ($env:PLUGIN_SUBMODULE_INCLUDE -or $env:PLUGIN_SUBMODULE_EXCLUDE) {
+    $all = git config --file .gitmodules --get-regexp '\.path$' | ForEach-Object { ($_ -split " ", 2)[1] }
+    foreach ($path in $all) {
+        if ($env:PLUGIN_SUBMODULE_INCLUDE -and -not (Test-SubmodulePath $path $env:PLUGIN_SUBMODULE_INCLUDE)) {
+            continue
+        }
+        if ($env:PLUGIN_SUBMODULE_EXCLUDE -and (Test-SubmodulePath $path $env:PLUGIN_SUBMODULE_EXCLUDE)) {
+            continue
+        }
+        $paths += $path
+    }
+
+    if ($paths.Count -eq 0) {
+        Write-Host "[INFO] no submodules selected"
+        return
+    }
+}
+
+# rewrite submodule URLs to the protocol that has credentials. The rules
+# only apply to the submodule update through GIT_CONFIG_COUNT and are scoped
+# to DRONE_NETRC_MACHINE; PLUGIN_SUBMODULE_URL_REWRITES adds explicit
+# prefix=replacement rules. Relative submodule URLs resolve against origin
+# before the rules apply.
+function Add-InsteadOf {
+    param (
+        $prefix,
+        $replacement
+    )
+
+    Write-Host "[INFO] rewriting submodule URLs starting with $(Get-MaskedUrl $prefix) to $(Get-MaskedUrl $replacement)"
+    $count = 0
+    if ($env:GIT_CONFIG_COUNT) {
+        $count = [int]$env:GIT_CONFIG_COUNT
+    }
+    Set-Item -Path "env:GIT_CONFIG_KEY_$count" -Value "url.$replacement.insteadOf"
+    Set-Item -Path "env:GIT_CONFIG_VALUE_$count" -Value $prefix
+    $env:GIT_CONFIG_COUNT = $count + 1
+}
+
+if ($env:PLUGIN_SUBMODULE_URL_REWRITE -ne "false" -and $env:DRONE_NETRC_MACHINE) {
+    $protocol = ""
+    if ($env:DRONE_SSH_KEY -and $env:DRONE_NETRC_PASSWORD) {
+        # both are configured, keep the protocol of the repository
+        if ($env:DRONE_REMOTE_URL -match "^https?://") {
+            $protocol = "https"
+        } else {
+            $protocol = "ssh"
+        }
+    } elseif ($env:DRONE_SSH_KEY) {
+        $protocol = "ssh"
+    } elseif ($env:DRONE_NETRC_PASSWORD) {
+        $protocol = "https"
+    }
+
+    $hostname = $env:DRONE_NETRC_MACHINE
+    if ($protocol -eq "https") {
+        Add-InsteadOf "git@${hostname}:" "https://${hostname}/"
+        Add-InsteadOf "ssh://git@${hostname}/" "https://${hostname}/"
+    } elseif ($protocol -eq "ssh") {
+        if ($env:DRONE_NETRC_PORT) {
+            Add-InsteadOf "https://${hostname}/" "ssh://git@${hostname}:$env:DRONE_NETRC_PORT/"
+        } else {
+            Add-InsteadOf "https://${hostname}/" "git@${hostname}:"
+        }
+    }
+}
+
+# the local config written for PLUGIN_URL_REWRITES in isolated mode is not
+# seen by the submodule clones
+$rewrites = @($env:PLUGIN_SUBMODULE_URL_REWRITES)
+if ($env:HARNESS_GIT_CONFIG_FOLDER -and $env:PLUGIN_URL_REWRITES) {
+    $rewrites = @($env:PLUGIN_URL_REWRITES) + $rewrites
+}
+
+if ($rewrites -join "") {
+    foreach ($rule in ($rewrites -join "`n") -split "[,`n]") {
+        $rule = $rule.Trim()
+        if ($rule -eq "") {
+            continue
+        }
+        $prefix, $replacement = $rule -split "=", 2
+        if ($null -eq $replacement) {
+            Throw "invalid submodule URL rewrite $(Get-MaskedUrl $rule), expected prefix=replacement"
+        }
+        Add-InsteadOf $prefix $replacement
+    }
+}
+
+$retries = 0
+if ($env:PLUGIN_SUBMODULE_RETRIES) {
+    $retries = [int]$env:PLUGIN_SUBMODULE_RETRIES
+}
+$delay = 2
+
+for ($attempt = 1; ; $attempt++) {
+    if ($paths.Count -gt 0) {
+        Write-Host "+ git submodule update $flags -- $paths"
+        git submodule update @flags -- @paths
+    } else {
+        Write-Host "+ git submodule update $flags"
+        git submodule update @flags
+    }
+    if (-not $LASTEXITCODE) {
+        break
+    }
+
+    if ($attempt -gt $retries) {
+        Throw "git submodule update failed (exit code $LASTEXITCODE)."
+    }
+    Write-Host "[INFO] submodule update failed, retrying in ${delay}s (attempt $attempt of $retries)"
+    Start-Sleep -Seconds $delay
+    $delay *= 2
+}
@@ -0,0 +1,72 @@
+. "${PSScriptRoot}\utility.ps1"
+
+Set-Alias iu Invoke-Utility
+
+# if a worktree path is configured, check out the pull request target
+# branch (or PLUGIN_WORKTREE_REF) as a linked worktree next to the pull
+# request so that diff based tools can compare both trees. The worktree
+# shares the object store of the workspace repository.
+
+if (-not [string]::IsNullOrEmpty($Env:PLUGIN_WORKTREE_PATH)) {
+    Set-Variable -Name "FLAGS" -Value ""
+    if ($Env:PLUGIN_DEPTH) {
+        Set-Variable -Name "FLAGS" -Value "--depth=$Env:PLUGIN_DEPTH"
+    }
+
+    $worktreeRef = $Env:PLUGIN_WORKTREE_REF
+    if ([string]::IsNullOrEmpty($worktreeRef)) {
+        $worktreeRef = $Env:DRONE_COMMIT_BRANCH
+    }
+
+    Write-Host "+ git worktree prune"
+    iu git worktree prune
+    # a path left by a previous build is only replaced when it is a worktree
+    # of this repository, anything else at the path is kept
+    if (Test-Path $Env:PLUGIN_WORKTREE_PATH) {
+        $worktreePath = (Resolve-Path $Env:PLUGIN_WORKTREE_PATH).Path -replace '\\', '/'
+        $registered = git worktree list --porcelain |
+            Where-Object { $_ -like "worktree *" } |
+            Select-Object -Skip 1 |
+            Where-Object { ($_.Substring(9) -replace '\\', '/') -ieq $worktreePath }
+        if (-not $registered) {
+            Throw "PLUGIN_WORKTREE_PATH $Env:PLUGIN_WORKTREE_PATH exists and is not a worktree of this repository"
+        }
+        Write-Host "+ git worktree remove --force $Env:PLUGIN_WORKTREE_PATH"
+        iu git worktree remove --force $Env:PLUGIN_WORKTREE_PATH
+    }
+
+    if ([string]::IsNullOrEmpty($FLAGS)) {
+        Write-Host "+ git fetch origin $worktreeRef"
+        iu git fetch origin $worktreeRef
+    } else {
+        Write-Host "+ git fetch $FLAGS origin $worktreeRef"
+        iu git fetch $FLAGS origin $worktreeRef
+    }
+    $baseSha = (git rev-parse FETCH_HEAD)
+
+    # the merge strategy checks out the pull request merged into the target
+    # branch, which may have moved since. Compare against the target commit
+    # the pull request was merged into rather than the current branch tip.
+    if ([string]::IsNullOrEmpty($Env:PLUGIN_WORKTREE_REF) -and $Env:PLUGIN_PR_CLONE_STRATEGY -ne "SourceBranch") {
+        $mergeBase = (git merge-base HEAD FETCH_HEAD)
+        if (-not $LASTEXITCODE) {
+            $baseSha = $mergeBase
+        }
+    }
+
+    Write-Host "+ git worktree add --detach $Env:PLUGIN_WORKTREE_PATH $baseSha"
+    iu git worktree add --detach $Env:PLUGIN_WORKTREE_PATH $baseSha
+
+    $headPath = (Get-Location).Path
+    $headSha = (git rev-parse HEAD)
+    $basePath = (Resolve-Path $Env:PLUGIN_WORKTREE_PATH).Path
+
+    Write-Host "[INFO] base $baseSha checked out at $basePath"
+
+    if ($Env:DRONE_OUTPUT) {
+        "WORKTREE_BASE_PATH=$basePath" | Out-File -FilePath $Env:DRONE_OUTPUT -Encoding ascii -Append
+        "WORKTREE_BASE_SHA=$baseSha" | Out-File -FilePath $Env:DRONE_OUTPUT -Encoding ascii -Append
+        "WORKTREE_HEAD_PATH=$headPath" | Out-File -FilePath $Env:DRONE_OUTPUT -Encoding ascii -Append
+        "WORKTREE_HEAD_SHA=$headSha" | Out-File -FilePath $Env:DRONE_OUTPUT -Encoding ascii -Append
+    }
+}
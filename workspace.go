@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// defaultWorkspaceCheckTimeout bounds the integrity probe so that very large
+// repositories do not delay every build.
+const defaultWorkspaceCheckTimeout = 60 * time.Second
+
+// defaultQuarantineLimit is the number of quarantined repositories kept for
+// inspection, the oldest are removed
+const defaultQuarantineLimit = 3
+
+// WorkspaceReport records the integrity check of a persisted workspace
+type WorkspaceReport struct {
+	Path           string `json:"path"`
+	Reused         bool   `json:"reused"`
+	Corrupted      bool   `json:"corrupted"`
+	Error          string `json:"error,omitempty"`
+	QuarantinePath string `json:"quarantine_path,omitempty"`
+	Recloned       bool   `json:"recloned"`
+}
+
+// checkWorkspace probes an existing .git directory in workdir before it is
+// reused. A damaged repository is moved out of the way together with the
+// working tree so that the clone scripts start from an empty workspace.
+func checkWorkspace(workdir string) (*WorkspaceReport, error) {
+	report := &WorkspaceReport{Path: workdir}
+
+	if _, err := os.Stat(filepath.Join(workdir, ".git")); err != nil {
+		return report, nil // Nothing persisted, fresh clone
+	}
+	report.Reused = true
+
+	timeout := defaultWorkspaceCheckTimeout
+	if value := os.Getenv("PLUGIN_WORKSPACE_CHECK_TIMEOUT"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PLUGIN_WORKSPACE_CHECK_TIMEOUT %q: %v", value, err)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	corrupted, err := probeRepository(ctx, workdir)
+	if err == nil {
+		return report, nil
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		// An inconclusive probe is not a reason to throw the workspace away
+		slog.Warn("Workspace integrity check timed out, reusing workspace", "dir", workdir, "timeout", timeout)
+		return report, nil
+	}
+	if !corrupted {
+		return nil, fmt.Errorf("failed to check workspace %s: %v", workdir, err)
+	}
+
+	slog.Warn("Workspace repository is corrupted, starting from a fresh clone", "dir", workdir, "error", err)
+	report.Corrupted = true
+	report.Error = err.Error()
+
+	quarantinePath, err := quarantineWorkspace(workdir)
+	if err != nil {
+		return nil, err
+	}
+	report.QuarantinePath = quarantinePath
+	report.Recloned = true
+	return report, nil
+}
+
+// probeRepository runs quick read-only checks that fail on truncated packs,
+// broken refs and missing objects. It reports whether a failure comes from
+// the repository: a .git that git refuses to open, such as one with an empty
+// HEAD after an interrupted run, is corrupted too, unless git only doubts its
+// ownership. The repository is trusted like the clone scripts do with
+// safe.directory, since a persisted workspace is often owned by another user.
+func probeRepository(ctx context.Context, workdir string) (bool, error) {
+	if _, err := runGit(ctx, workdir, "-c", "safe.directory=*", "rev-parse", "--git-dir"); err != nil {
+		var exitErr *exec.ExitError
+		return errors.As(err, &exitErr) && !strings.Contains(err.Error(), "dubious ownership"), err
+	}
+	if _, err := runGit(ctx, workdir, "-c", "safe.directory=*", "fsck", "--connectivity-only", "--no-dangling", "--no-progress"); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// quarantineWorkspace moves the damaged .git directory to the quarantine
+// directory and empties the workspace. The workspace directory itself is kept
+// since it is often a volume mount. If the repository cannot be moved it is
+// removed and an empty quarantine path is returned.
+func quarantineWorkspace(workdir string) (string, error) {
+	quarantineDir := os.Getenv("PLUGIN_WORKSPACE_QUARANTINE_DIR")
+	if quarantineDir == "" {
+		quarantineDir = filepath.Join(filepath.Dir(workdir), ".drone-git-quarantine")
+	}
+	quarantinePath := filepath.Join(quarantineDir,
+		fmt.Sprintf("%s-%d.git", filepath.Base(workdir), time.Now().Unix()))
+
+	gitDir := filepath.Join(workdir, ".git")
+	if err := os.MkdirAll(quarantineDir, 0700); err == nil {
+		if err := os.Rename(gitDir, quarantinePath); err != nil {
+			slog.Warn("Failed to quarantine repository, removing it instead", "dir", gitDir, "error", err)
+			quarantinePath = ""
+		} else {
+			// Pruning keeps the most recently quarantined repositories
+			now := time.Now()
+			os.Chtimes(quarantinePath, now, now)
+		}
+	} else {
+		slog.Warn("Failed to create quarantine directory, removing repository instead", "dir", quarantineDir, "error", err)
+		quarantinePath = ""
+	}
+
+	entries, err := os.ReadDir(workdir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read workspace %s: %v", workdir, err)
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(workdir, entry.Name())); err != nil {
+			return "", fmt.Errorf("failed to clean workspace %s: %v", workdir, err)
+		}
+	}
+
+	if quarantinePath != "" {
+		slog.Info("Quarantined corrupted repository", "path", quarantinePath)
+		pruneQuarantine(quarantineDir)
+	}
+	return quarantinePath, nil
+}
+
+// pruneQuarantine removes the oldest quarantined repositories beyond
+// PLUGIN_WORKSPACE_QUARANTINE_LIMIT so that the quarantine directory does
+// not grow with every corrupted workspace. Only the *.git directories
+// created by quarantineWorkspace are considered.
+func pruneQuarantine(quarantineDir string) {
+	limit := defaultQuarantineLimit
+	if value := os.Getenv("PLUGIN_WORKSPACE_QUARANTINE_LIMIT"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			limit = n
+		} else {
+			slog.Warn("Invalid PLUGIN_WORKSPACE_QUARANTINE_LIMIT, using the default", "value", value, "default", limit)
+		}
+	}
+
+	entries, err := os.ReadDir(quarantineDir)
+	if err != nil {
+		slog.Warn("Failed to read quarantine directory", "dir", quarantineDir, "error", err)
+		return
+	}
+	type quarantined struct {
+		path    string
+		modTime time.Time
+	}
+	var repositories []quarantined
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasSuffix(entry.Name(), ".git") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		repositories = append(repositories, quarantined{filepath.Join(quarantineDir, entry.Name()), info.ModTime()})
+	}
+	if len(repositories) <= limit {
+		return
+	}
+
+	sort.Slice(repositories, func(i, j int) bool { return repositories[i].modTime.After(repositories[j].modTime) })
+	for _, repository := range repositories[limit:] {
+		if err := os.RemoveAll(repository.path); err != nil {
+			slog.Warn("Failed to remove quarantined repository", "path", repository.path, "error", err)
+			continue
+		}
+		slog.Debug("Removed quarantined repository", "path", repository.path)
+	}
+}
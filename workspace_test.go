@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckWorkspace_Fresh(t *testing.T) {
+	dir := t.TempDir()
+
+	report, err := checkWorkspace(dir)
+	require.NoError(t, err)
+	assert.False(t, report.Reused)
+	assert.False(t, report.Corrupted)
+}
+
+func TestCheckWorkspace_Healthy(t *testing.T) {
+	dir := newTestRepo(t)
+
+	report, err := checkWorkspace(dir)
+	require.NoError(t, err)
+	assert.True(t, report.Reused)
+	assert.False(t, report.Corrupted)
+	assert.FileExists(t, filepath.Join(dir, "README.md"))
+}
+
+func TestCheckWorkspace_Corrupted(t *testing.T) {
+	dir := newTestRepo(t)
+	quarantineDir := t.TempDir()
+	os.Setenv("PLUGIN_WORKSPACE_QUARANTINE_DIR", quarantineDir)
+	defer os.Unsetenv("PLUGIN_WORKSPACE_QUARANTINE_DIR")
+
+	// Remove the blob object to simulate an interrupted fetch
+	blob := gitCmd(t, dir, "rev-parse", "HEAD:README.md")
+	require.NoError(t, os.Remove(filepath.Join(dir, ".git", "objects", blob[:2], blob[2:])))
+
+	report, err := checkWorkspace(dir)
+	require.NoError(t, err)
+	assert.True(t, report.Reused)
+	assert.True(t, report.Corrupted)
+	assert.True(t, report.Recloned)
+	assert.Contains(t, report.Error, "missing blob")
+
+	// The workspace is emptied and the repository kept for inspection
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.DirExists(t, report.QuarantinePath)
+	assert.FileExists(t, filepath.Join(report.QuarantinePath, "HEAD"))
+}
+
+func TestCheckWorkspace_BrokenHead(t *testing.T) {
+	dir := newTestRepo(t)
+	setTestEnv(t, map[string]string{"PLUGIN_WORKSPACE_QUARANTINE_DIR": t.TempDir()})
+
+	// An interrupted run can leave an empty HEAD, git no longer opens the repository
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".git", "HEAD"), nil, 0644))
+
+	report, err := checkWorkspace(dir)
+	require.NoError(t, err)
+	assert.True(t, report.Corrupted)
+	assert.True(t, report.Recloned)
+	assert.Contains(t, report.Error, "git rev-parse failed")
+	assert.NoDirExists(t, filepath.Join(dir, ".git"))
+	assert.DirExists(t, report.QuarantinePath)
+}
+
+func TestCheckWorkspace_OtherOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of the repository requires root")
+	}
+	dir := newTestRepo(t)
+	require.NoError(t, filepath.Walk(dir, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, 12345, 12345)
+	}))
+	setTestEnv(t, map[string]string{"GIT_CONFIG_GLOBAL": "/dev/null"})
+
+	// git reports dubious ownership, which is not a corruption
+	report, err := checkWorkspace(dir)
+	require.NoError(t, err)
+	assert.True(t, report.Reused)
+	assert.False(t, report.Corrupted)
+	assert.FileExists(t, filepath.Join(dir, "README.md"))
+}
+
+func TestPruneQuarantine(t *testing.T) {
+	quarantineDir := t.TempDir()
+	setTestEnv(t, map[string]string{"PLUGIN_WORKSPACE_QUARANTINE_LIMIT": "2"})
+
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		path := filepath.Join(quarantineDir, fmt.Sprintf("workspace-%d.git", i))
+		require.NoError(t, os.Mkdir(path, 0700))
+		require.NoError(t, os.Chtimes(path, now, now.Add(time.Duration(i)*time.Minute)))
+	}
+	other := filepath.Join(quarantineDir, "notes")
+	require.NoError(t, os.Mkdir(other, 0700))
+
+	pruneQuarantine(quarantineDir)
+
+	assert.NoDirExists(t, filepath.Join(quarantineDir, "workspace-0.git"))
+	assert.NoDirExists(t, filepath.Join(quarantineDir, "workspace-1.git"))
+	assert.DirExists(t, filepath.Join(quarantineDir, "workspace-2.git"))
+	assert.DirExists(t, filepath.Join(quarantineDir, "workspace-3.git"))
+	assert.DirExists(t, other, "only quarantined repositories are pruned")
+}
+
+func TestPrepareWorkspace_Report(t *testing.T) {
+	dir := newTestRepo(t)
+	reportFile := filepath.Join(t.TempDir(), "clone-report.json")
+	os.Setenv("DRONE_WORKSPACE", dir)
+	os.Setenv("PLUGIN_CLONE_REPORT_FILE", reportFile)
+	defer func() {
+		os.Unsetenv("DRONE_WORKSPACE")
+		os.Unsetenv("PLUGIN_CLONE_REPORT_FILE")
+	}()
+
+	require.NoError(t, prepareWorkspace())
+
+	report := &CloneReport{}
+	require.NoError(t, updateCloneReport(func(r *CloneReport) { *report = *r }))
+	require.NotNil(t, report.Workspace)
+	assert.Equal(t, dir, report.Workspace.Path)
+	assert.True(t, report.Workspace.Reused)
+	assert.False(t, report.Workspace.Corrupted)
+}